@@ -1,36 +1,376 @@
 package main
 
 import (
+	"fmt"
 	"github.com/isbm/go-nanoconf"
 	daemon "github.com/isbm/uyuni-ncd"
+	"github.com/isbm/uyuni-ncd/transport"
 	"github.com/isbm/uyuni-ncd/transport/eventmappers"
 	"github.com/urfave/cli/v2"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func run(ctx *cli.Context) error {
+// Setup node key and trusted keys of the other nodes
+func getSigner(cfg *nanoconf.Config) (*ncdtransport.MessageSigner, error) {
+	sec := findSection(cfg, "security")
+	name := sec.String("name", "")
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	signer := ncdtransport.NewMessageSigner(name).SetVerify(sec.DefaultBool("verify", "", true))
+	if err := signer.LoadKey(sec.DefaultString("key", "", "/etc/ncd/node.key")); os.IsNotExist(err) {
+		return nil, fmt.Errorf("node key is missing, run \"ncd init-keys\" first: %s", err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	if trusted := sec.DefaultString("trusted", "", "/etc/ncd/trusted.keys"); trusted != "" {
+		if err := signer.LoadTrustedKeys(trusted); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, leader := range strings.Split(sec.String("leaders", ""), ",") {
+		if leader = strings.TrimSpace(leader); leader != "" {
+			signer.AddLeader(leader)
+		}
+	}
+	for _, director := range strings.Split(sec.String("directors", ""), ",") {
+		if director = strings.TrimSpace(director); director != "" {
+			signer.AddDirector(director)
+		}
+	}
+	signer.SetReplayWindow(time.Duration(sec.DefaultInt("replay-window", "", 300)) * time.Second)
+	// Own messages are always trusted
+	if err := signer.AddTrustedKey(name, signer.PublicKey()); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// Setup payload encryption per topic
+func getCipher(cfg *nanoconf.Config, name string) (*ncdtransport.PayloadCipher, error) {
+	enc := findSection(cfg, "encryption")
+	cipher := ncdtransport.NewPayloadCipher(name)
+	for mode, key := range map[string]string{
+		ncdtransport.ENCRYPT_CLUSTER:    "cluster-topics",
+		ncdtransport.ENCRYPT_RECIPIENTS: "recipients-topics"} {
+		for _, prefix := range strings.Split(enc.String(key, ""), ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				if err := cipher.Encrypt(prefix, mode); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := cipher.LoadKeyring(enc.DefaultString("keyring", "", "/etc/ncd/cluster.keys")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if current := enc.String("current", ""); current != "" {
+		if err := cipher.SetCurrentKey(current); err != nil {
+			return nil, err
+		}
+	}
+	if err := cipher.LoadBoxKey(enc.DefaultString("box-key", "", "/etc/ncd/node.box")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := cipher.LoadRecipients(enc.DefaultString("recipients", "", "/etc/ncd/recipients.keys")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return cipher, nil
+}
+
+// Generate the missing keys of the node and the first cluster key. Existing keys are kept.
+func initKeys(ctx *cli.Context) error {
+	cfg := nanoconf.NewConfig(ctx.String("config"))
+	enc := findSection(cfg, "encryption")
+	keys := []struct {
+		fpath    string
+		generate func(string) error
+	}{
+		{findSection(cfg, "security").DefaultString("key", "", "/etc/ncd/node.key"), ncdtransport.GenerateKey},
+		{enc.DefaultString("box-key", "", "/etc/ncd/node.box"), ncdtransport.GenerateBoxKey},
+		{enc.DefaultString("keyring", "", "/etc/ncd/cluster.keys"), func(fpath string) error {
+			return ncdtransport.RotateKeyring(fpath, time.Now().UTC().Format("20060102150405"))
+		}},
+	}
+	for _, key := range keys {
+		if _, err := os.Stat(key.fpath); err == nil {
+			fmt.Printf("%s already exists\n", key.fpath)
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := key.generate(key.fpath); err != nil {
+			return err
+		}
+		fmt.Printf("%s has been generated\n", key.fpath)
+	}
+	return nil
+}
+
+// Print the public keys of the node for the trusted keys and recipients files of the other nodes
+func showKey(ctx *cli.Context) error {
+	cfg := nanoconf.NewConfig(ctx.String("config"))
+	signer, err := getSigner(cfg)
+	if err != nil {
+		return err
+	}
+	cipher, err := getCipher(cfg, signer.Name())
+	if err != nil {
+		return err
+	}
+	fmt.Println("Signing key (trusted keys):")
+	fmt.Println(signer.Name(), signer.PublicKey())
+	fmt.Println("Encryption key (recipients):")
+	fmt.Println(signer.Name(), cipher.BoxPublicKey())
+	return nil
+}
+
+// Add a new cluster key to the keyring. The keyring should be then distributed to all the nodes.
+func rotateKey(ctx *cli.Context) error {
+	keyring := findSection(nanoconf.NewConfig(ctx.String("config")), "encryption").DefaultString("keyring", "", "/etc/ncd/cluster.keys")
+	id := time.Now().UTC().Format("20060102150405")
+	if err := ncdtransport.RotateKeyring(keyring, id); err != nil {
+		return err
+	}
+	fmt.Printf("New cluster key %s has been added to %s\n", id, keyring)
+	fmt.Printf("Copy the keyring to all the nodes, then set \"current: %s\" on the leader\n", id)
+	return nil
+}
+
+// Load column rules of the captured tables of the database section
+func getColumnRules(db *confSection) (*ncdtransport.PgColumnRules, error) {
+	rules := ncdtransport.NewPgColumnRules()
+	if err := rules.LoadRules(db.DefaultString("rules", "", "/etc/ncd/triggers.rules")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Configuration section of the database source. Main Uyuni database is "db", others are "db-<name>".
+func dbSection(cfg *nanoconf.Config, source string) *confSection {
+	if source == "" || source == ncdtransport.PG_DEFAULT_SOURCE {
+		return findSection(cfg, "db")
+	}
+	return findSection(cfg, "db-"+source)
+}
+
+// Print triggers of the captured tables with their column rules
+func showTriggers(ctx *cli.Context) error {
+	db := dbSection(nanoconf.NewConfig(ctx.String("config")), ctx.Args().First())
+	rules, err := getColumnRules(db)
+	if err != nil {
+		return err
+	}
+	if len(rules.Tables()) == 0 {
+		return fmt.Errorf("no tables to capture")
+	}
+	function := "notify_payload_event"
+	if db.DefaultBool("event-log", "", true) {
+		function = "notify_event"
+	}
+	fmt.Print(rules.TriggerSQL(function))
+	return nil
+}
+
+// Setup listener of the database source from its configuration section
+func setupDBListener(db *confSection, dbl *ncdtransport.PgEventListener, consumer string) error {
+	rules, err := getColumnRules(db)
+	if err != nil {
+		return err
+	}
+	channels := "cluster"
+	if len(rules.Tables()) > 0 {
+		channels = strings.Join(rules.Channels(), ",")
+	}
+	dbl.
+		SetURI(db.String("uri", "")).
+		SetHost(db.String("host", "")).
+		SetPort(db.DefaultInt("port", "", 5432)).
+		AddChannels(db.DefaultString("channels", "", channels)).
+		SetDBName(db.String("database", "")).
+		SetUser(db.String("user", "")).
+		SetPassword(db.String("password", "")).
+		SetPassFile(db.String("passfile", "")).
+		SetSSLRootCert(db.String("sslrootcert", "")).
+		SetSSLCert(db.String("sslcert", ""), db.String("sslkey", ""))
+
+	// "ssl: false" of the older configurations
+	sslmode := ncdtransport.PG_SSL_PREFER
+	if !db.DefaultBool("ssl", "", true) {
+		sslmode = ncdtransport.PG_SSL_DISABLE
+	}
+	if err := dbl.SetSSLMode(db.DefaultString("sslmode", "", sslmode)); err != nil {
+		return err
+	}
+
+	switch source := db.DefaultString("source", "", "triggers"); source {
+	case "triggers":
+	case "logical":
+		logical := ncdtransport.NewPgLogicalSource(db.DefaultString("slot", "", "ncd")).
+			SetPublication(db.String("publication", "")).
+			AddTables(db.DefaultString("tables", "", strings.Join(rules.Tables(), ",")))
+		if err := logical.SetPlugin(db.DefaultString("plugin", "", ncdtransport.PG_PLUGIN_WAL2JSON)); err != nil {
+			return err
+		}
+		dbl.
+			SetLogicalSource(logical, time.Duration(db.DefaultInt("poll", "", 1))*time.Second).
+			SetColumnRules(rules)
+	default:
+		return fmt.Errorf("unknown db source: %s", source)
+	}
+	dbl.SetReconnectWait(time.Duration(db.DefaultInt("reconnect-wait", "", 1))*time.Second,
+		time.Duration(db.DefaultInt("reconnect-max-wait", "", 60))*time.Second)
+	dbl.GetWorkers().
+		SetWorkers(db.DefaultInt("workers", "", 4)).
+		SetQueue(db.DefaultInt("queue", "", 1000))
+	debouncer := ncdtransport.NewPgDebouncer().
+		SetWindow(time.Duration(db.DefaultInt("debounce", "", 0)) * time.Millisecond)
+	for table, window := range rules.Debounce() {
+		debouncer.SetTableWindow(table, window)
+	}
+	if debouncer.Enabled() {
+		dbl.SetDebouncer(debouncer)
+	}
+	if db.DefaultBool("event-log", "", true) {
+		dbl.SetEventLog(ncdtransport.NewPgEventLog(db.DefaultString("consumer", "", consumer)).
+			SetGapTimeout(time.Duration(db.DefaultInt("gap-timeout", "", 30)) * time.Second))
+	}
+	return nil
+}
+
+// Setup ncd from the configuration
+func setup(ctx *cli.Context) (*daemon.Ncd, error) {
 	cfg := nanoconf.NewConfig(ctx.String("config"))
-	ncd := daemon.NewNcd()
-	ncd.GetTransport().AddNatsServerURL(
-		cfg.Find("bus").String("host", ""),
-		cfg.Find("bus").DefaultInt("port", "", 4222))
-
-	ncd.GetDBListener().
-		SetHost(cfg.Find("db").String("host", "")).
-		SetChannel("cluster").
-		SetDBName(cfg.Find("db").String("database", "")).
-		SetUser(cfg.Find("db").String("user", "")).
-		SetPassword(cfg.Find("db").String("password", "")).
-		SetSSLMode(false)
+	bus := findSection(cfg, "bus")
+
+	var ncd *daemon.Ncd
+	switch mode := bus.DefaultString("mode", "", "nats"); mode {
+	case "nats":
+		ncd = daemon.NewNcd()
+	case "memory":
+		ncd = daemon.NewNcdWithBus(ncdtransport.NewMemBus(nil))
+	default:
+		return nil, fmt.Errorf("unknown bus mode: %s", mode)
+	}
+
+	signer, err := getSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ncd.SetSigner(signer)
+
+	cipher, err := getCipher(cfg, signer.Name())
+	if err != nil {
+		return nil, err
+	}
+	ncd.SetCipher(cipher)
+
+	if nats := ncd.GetTransport(); nats != nil {
+		if bus.DefaultBool("embedded", "", false) {
+			nats.SetEmbeddedServer(ncdtransport.NewEmbeddedNatsServer().
+				SetListen(bus.DefaultString("embedded-host", "", "127.0.0.1"), bus.DefaultInt("embedded-port", "", 4222)).
+				SetCluster(bus.DefaultString("cluster-host", "", "127.0.0.1"), bus.DefaultInt("cluster-port", "", 0)).
+				SetRouteAuth(bus.String("route-user", ""), bus.String("route-password", "")).
+				AddRoutes(bus.String("routes", "")).
+				SetVerbose(bus.DefaultBool("embedded-log", "", false)))
+		} else if servers := bus.String("servers", ""); servers != "" {
+			nats.AddNatsServerURLs(servers)
+		} else {
+			nats.AddNatsServerURL(
+				bus.DefaultString("host", "", "localhost"),
+				bus.DefaultInt("port", "", 4222))
+		}
+		nats.
+			SetReconnectWait(time.Duration(bus.DefaultInt("reconnect-wait", "", 1))*time.Second,
+				time.Duration(bus.DefaultInt("reconnect-max-wait", "", 60))*time.Second).
+			SetBufferSize(bus.DefaultInt("buffer", "", 10000)).
+			SetTLS(bus.String("ca", ""), bus.String("cert", ""), bus.String("key", "")).
+			SetUserPassword(bus.String("user", ""), bus.String("password", "")).
+			SetToken(bus.String("token", "")).
+			SetNKeySeed(bus.String("nkey", "")).
+			SetCredentialsFile(bus.String("creds", "")).
+			SetInsecure(bus.DefaultBool("insecure", "", false))
+	}
+
+	if err := ncd.GetWireCodec().SetCodec(bus.DefaultString("codec", "", "json")); err != nil {
+		return nil, err
+	}
+	if err := ncd.GetWireCodec().SetCompression(bus.DefaultString("compression", "", "none")); err != nil {
+		return nil, err
+	}
+	ncd.GetWireCodec().SetThreshold(bus.DefaultInt("compression-threshold", "", 1024))
+	ncd.GetSequencer().
+		SetRetention(bus.DefaultInt("retention", "", 1000)).
+		SetTimeout(time.Duration(bus.DefaultInt("retransmit-timeout", "", 5)) * time.Second).
+		SetAnnounceInterval(time.Duration(bus.DefaultInt("announce-interval", "", 10)) * time.Second)
+	ncd.GetTxAssembler().SetTimeout(time.Duration(bus.DefaultInt("tx-timeout", "", 5)) * time.Second)
 
+	if err := setupDBListener(findSection(cfg, "db"), ncd.GetDBListener(), signer.Name()); err != nil {
+		return nil, err
+	}
+	for _, source := range strings.Split(findSection(cfg, "db").String("sources", ""), ",") {
+		if source = strings.TrimSpace(source); source != "" {
+			if err := setupDBListener(dbSection(cfg, source), ncd.AddDBListener(source), signer.Name()); err != nil {
+				return nil, fmt.Errorf("db source %s: %s", source, err.Error())
+			}
+		}
+	}
+
+	ncd.GetObjectTransfer().
+		SetSpoolDir(findSection(cfg, "objects").DefaultString("spool", "", "/var/spool/ncd/objects")).
+		SetChunkSize(findSection(cfg, "objects").DefaultInt("chunk", "", 0))
+
+	api := findSection(cfg, "api")
 	msgmap := eventmappers.NewUyuniEventMapper().
-		SetRPCUrl(cfg.Find("api").String("url", "")).
-		SetRPCUser(cfg.Find("api").String("user", "")).
-		SetRPCPassword(cfg.Find("api").String("password", ""))
+		SetRPCUrl(api.String("url", "")).
+		SetRPCUser(api.String("user", "")).
+		SetRPCPassword(api.String("password", "")).
+		SetTLSVerify(api.DefaultBool("tls-verify", "", true)).
+		SetRPCTimeout(time.Duration(api.DefaultInt("timeout", "", 30)) * time.Second)
 
 	ncd.AddMapper(msgmap).SetLeader(ctx.Bool("leader"))
+	for _, topic := range ncdtransport.ParseTopicSubscriptions(bus.String("subscribe", "")) {
+		ncd.AddTopicSubscription(topic.Pattern, topic.Queue)
+	}
+
+	ncd.GetDeadLetters().SetDir(findSection(cfg, "deadletters").DefaultString("dir", "", "/var/lib/ncd/deadletters"))
 
+	return ncd, nil
+}
+
+func run(ctx *cli.Context) error {
+	ncd, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Stop cleanly, so the queued database events are sent
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopping, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		<-signals
+		close(stopping)
+		ncd.Stop()
+		close(stopped)
+	}()
 	ncd.Run()
+	select {
+	case <-stopping:
+		<-stopped
+	default:
+	}
 	return nil
 }
 
@@ -43,6 +383,30 @@ func main() {
 		Name:    appname,
 		Usage:   "Cluster Node Controller Daemon",
 		Action:  run,
+		Commands: []*cli.Command{
+			{
+				Name:   "init-keys",
+				Usage:  "Generate the missing node keys and the cluster keyring",
+				Action: initKeys,
+			},
+			{
+				Name:   "key",
+				Usage:  "Show node name and public keys for the trusted keys and recipients of the other nodes",
+				Action: showKey,
+			},
+			{
+				Name:      "triggers",
+				Usage:     "Generate triggers of the captured tables with their column rules",
+				ArgsUsage: "[source]",
+				Action:    showTriggers,
+			},
+			{
+				Name:   "rotate-key",
+				Usage:  "Add a new cluster key to the keyring, to be set current after it is distributed",
+				Action: rotateKey,
+			},
+			deadLettersCommand(),
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:     "config",
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/isbm/go-nanoconf"
+	"strconv"
+)
+
+// Section of the configuration with defaults for missing keys.
+// Missing section is empty, so all its keys get their defaults.
+type confSection struct {
+	values map[string]interface{}
+}
+
+// Find the configuration section
+func findSection(cfg *nanoconf.Config, name string) (section *confSection) {
+	section = &confSection{values: make(map[string]interface{})}
+	defer func() {
+		recover() // Inspector panics on a missing section
+	}()
+	section.values = *cfg.Find(name).Raw()
+	return section
+}
+
+// String value of the key, or empty string. Overlay, if not empty, wins.
+func (cs *confSection) String(key string, overlay string) string {
+	return cs.DefaultString(key, overlay, "")
+}
+
+// DefaultString returns string value of the key, or the default
+func (cs *confSection) DefaultString(key string, overlay string, value string) string {
+	if overlay != "" {
+		return overlay
+	}
+	if raw, ex := cs.values[key]; ex && raw != nil {
+		return fmt.Sprint(raw)
+	}
+	return value
+}
+
+// DefaultInt returns integer value of the key, or the default
+func (cs *confSection) DefaultInt(key string, overlay string, value int) int {
+	if data, err := strconv.Atoi(cs.DefaultString(key, overlay, "")); err == nil {
+		return data
+	}
+	return value
+}
+
+// DefaultBool returns boolean value of the key, or the default
+func (cs *confSection) DefaultBool(key string, overlay string, value bool) bool {
+	if data, err := strconv.ParseBool(cs.DefaultString(key, overlay, "")); err == nil {
+		return data
+	}
+	return value
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/isbm/uyuni-ncd/transport/eventmappers"
+	"github.com/urfave/cli/v2"
+)
+
+// Dead letters management: messages, which failed to apply on this node
+func deadLettersCommand() *cli.Command {
+	return &cli.Command{
+		Name:    "deadletters",
+		Aliases: []string{"dl"},
+		Usage:   "Manage messages, which failed to apply on this node",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List dead letters",
+				Action: listDeadLetters,
+			},
+			{
+				Name:      "show",
+				Usage:     "Show dead letter details",
+				ArgsUsage: "<message id>",
+				Action:    showDeadLetter,
+			},
+			{
+				Name:      "retry",
+				Usage:     "Apply dead letters again. Applied ones are removed.",
+				ArgsUsage: "<message id> [<message id> ...] | --all",
+				Flags:     []cli.Flag{&cli.BoolFlag{Name: "all", Usage: "Retry all dead letters"}},
+				Action:    retryDeadLetters,
+			},
+			{
+				Name:      "discard",
+				Usage:     "Remove dead letters without applying them",
+				ArgsUsage: "<message id> [<message id> ...]",
+				Action:    discardDeadLetters,
+			},
+		},
+	}
+}
+
+func listDeadLetters(ctx *cli.Context) error {
+	ncd, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	letters, err := ncd.GetDeadLetters().List()
+	if err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		fmt.Printf("%s  %s  %-8s %-30s attempts: %d, %s\n", letter.Id, letter.Updated.Format("2006-01-02 15:04:05"),
+			letter.Action, letter.Topic, letter.Attempts, letter.Error)
+	}
+	return nil
+}
+
+func showDeadLetter(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("message Id is required")
+	}
+	ncd, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	letter, err := ncd.GetDeadLetters().Get(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	fmt.Println("Id:      ", letter.Id)
+	fmt.Println("Topic:   ", letter.Topic)
+	fmt.Println("Action:  ", letter.Action)
+	fmt.Println("Created: ", letter.Created.Format("2006-01-02 15:04:05"))
+	fmt.Println("Updated: ", letter.Updated.Format("2006-01-02 15:04:05"))
+	fmt.Println("Attempts:", letter.Attempts)
+	fmt.Println("Error:   ", letter.Error)
+
+	if msg, err := ncd.GetWireCodec().Decode(letter.Data); err != nil {
+		fmt.Println("Message: ", err.Error())
+	} else {
+		fmt.Println("Message: ", msg.ToJSON())
+	}
+	return nil
+}
+
+func retryDeadLetters(ctx *cli.Context) error {
+	ncd, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	ids := ctx.Args().Slice()
+	if ctx.Bool("all") {
+		letters, err := ncd.GetDeadLetters().List()
+		if err != nil {
+			return err
+		}
+		for _, letter := range letters {
+			ids = append(ids, letter.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return errors.New("message Id is required")
+	}
+
+	failed := 0
+	for _, id := range ids {
+		if err := ncd.RetryDeadLetter(id); err == eventmappers.ErrParked {
+			fmt.Println(id, "is waiting for its prerequisites, kept")
+			failed++
+		} else if err != nil {
+			fmt.Println(id, "failed:", err.Error())
+			failed++
+		} else {
+			fmt.Println(id, "applied")
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dead letters are not applied", failed, len(ids))
+	}
+	return nil
+}
+
+func discardDeadLetters(ctx *cli.Context) error {
+	if ctx.NArg() == 0 {
+		return errors.New("message Id is required")
+	}
+	ncd, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ctx.Args().Slice() {
+		if err := ncd.GetDeadLetters().Remove(id); err != nil {
+			return err
+		}
+		fmt.Println(id, "discarded")
+	}
+	return nil
+}
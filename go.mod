@@ -5,15 +5,17 @@ go 1.13
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang/protobuf v1.3.3 // indirect
+	github.com/golang/protobuf v1.3.3
 	github.com/google/uuid v1.1.1
 	github.com/isbm/go-nanoconf v0.0.0-20200213162501-c88ba6d6d64c
-	github.com/kolo/xmlrpc v0.0.0-20190909154602-56d5ec7c422e
+	github.com/klauspost/compress v1.10.0
+	github.com/kolo/xmlrpc v0.0.0-20201022064351-38db28db192b
 	github.com/lib/pq v1.3.0
-	github.com/nats-io/nats-server/v2 v2.1.4 // indirect
-	github.com/nats-io/nats.go v1.9.1
+	github.com/nats-io/nats-server/v2 v2.1.4
+	github.com/nats-io/nats.go v1.10.0
 	github.com/urfave/cli/v2 v2.1.1
-	golang.org/x/crypto v0.0.0-20200214034016-1d94cc7ab1c6 // indirect
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
 	golang.org/x/sys v0.0.0-20200217220822-9197077df867 // indirect
 )
 
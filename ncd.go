@@ -6,14 +6,17 @@ import (
 	"fmt"
 	"github.com/isbm/uyuni-ncd/transport"
 	"github.com/isbm/uyuni-ncd/transport/eventmappers"
-	"github.com/nats-io/nats.go"
 	"log"
+	"os"
+	"path"
 	"strings"
+	"sync"
 )
 
 const (
 	CHANNEL_NODES    = "nodes"
 	CHANNEL_DIRECTOR = "director"
+	CHANNEL_OBJECTS  = "objects"
 )
 
 type NcdConf struct {
@@ -22,20 +25,72 @@ type NcdConf struct {
 }
 
 type Ncd struct {
-	rtconf    *NcdConf
-	transport *ncdtransport.NcdPubSub
-	dbl       *ncdtransport.PgEventListener
-	reflector *ncdtransport.MsgIdBuff
-	_mappers  []*eventmappers.Mapper
+	rtconf      *NcdConf
+	bus         ncdtransport.Bus
+	transport   *ncdtransport.NcdPubSub
+	dbls        []*ncdtransport.PgEventListener
+	reflector   *ncdtransport.MsgIdBuff
+	objects     *ncdtransport.ObjectTransfer
+	director    *ncdtransport.CdtTransport
+	codec       *ncdtransport.WireCodec
+	topics      []*ncdtransport.TopicSubscription
+	sequencer   *ncdtransport.Sequencer
+	deadletters *ncdtransport.DeadLetterStore
+	txs         *ncdtransport.TxAssembler
+	parked      map[string][]byte                  // Wire form of the parked messages. Requires parking lock.
+	held        map[string][]*ncdtransport.TxEntry // Messages, waiting for the recovery of their stream topic
+	holding     sync.Mutex
+	applying    sync.Mutex
+	parking     sync.Mutex
+	publishing  sync.Mutex // Keeps sequence numbers in order of sending
+	signer      *ncdtransport.MessageSigner
+	cipher      *ncdtransport.PayloadCipher
+	_mappers    []*eventmappers.Mapper
 }
 
+// NewNcd creates ncd on NATS bus
 func NewNcd() *Ncd {
+	pubsub := ncdtransport.NewNcdPubSub()
+	n := NewNcdWithBus(pubsub)
+	n.transport = pubsub
+
+	return n
+}
+
+// NewNcdWithBus creates ncd on any other bus, e.g. in-process MemBus
+func NewNcdWithBus(bus ncdtransport.Bus) *Ncd {
 	n := new(Ncd)
 	n.rtconf = &NcdConf{}
-	n.transport = ncdtransport.NewNcdPubSub()
-	n.dbl = ncdtransport.NewPgEventListener()
+	n.bus = bus
+	n.dbls = []*ncdtransport.PgEventListener{ncdtransport.NewPgEventListener()}
 	n.reflector = ncdtransport.NewMsgIdBuff()
+	n.codec = ncdtransport.NewWireCodec()
+	n.sequencer = ncdtransport.NewSequencer(n.bus)
+	n.deadletters = ncdtransport.NewDeadLetterStore("/var/lib/ncd/deadletters")
+	n.txs = ncdtransport.NewTxAssembler(n.applyTx)
+	n.parked = make(map[string][]byte)
+	n.held = make(map[string][]*ncdtransport.TxEntry)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		panic(err)
+	}
+	n.signer = ncdtransport.NewMessageSigner(hostname)
+	n.cipher = ncdtransport.NewPayloadCipher(hostname)
+	n.objects = ncdtransport.NewObjectTransfer(n.bus).SetSubject(CHANNEL_OBJECTS)
+	n.director = ncdtransport.NewCdtTransport(CHANNEL_DIRECTOR)
+	n.director.SetBus(n.bus)
+	n.director.SetSigner(n.signer)
+	n.objects.SetSigner(n.signer)
+	n.sequencer.SetSigner(n.signer)
 	n._mappers = make([]*eventmappers.Mapper, 0)
+	n.topics = make([]*ncdtransport.TopicSubscription, 0)
+
+	n.director.
+		OnCommand("ping", n.onPing).
+		OnCommand("deadletters.list", n.onDeadLettersList).
+		OnCommand("deadletters.retry", n.onDeadLettersRetry).
+		OnCommand("db.stats", n.onDBStats)
 
 	return n
 }
@@ -43,6 +98,10 @@ func NewNcd() *Ncd {
 // AddMapper adds a mapper to the ncd
 func (n *Ncd) AddMapper(mapper eventmappers.Mapper) *Ncd {
 	n._mappers = append(n._mappers, &mapper)
+	n.signer.AddLeaderTopic(mapper.TopicRoot())
+	if receiver, ok := mapper.(eventmappers.ParkingReceiver); ok {
+		receiver.OnParked(n.onParked)
+	}
 	return n
 }
 
@@ -57,14 +116,131 @@ func (n *Ncd) GetMapper(topic string) (*eventmappers.Mapper, error) {
 	return nil, fmt.Errorf("No mapper found for '%s' topic", topic)
 }
 
-// GetTransport returns NcdPubSub instance
+// AddTopicSubscription subscribes the node to the topics, matching the pattern, e.g. "/uyuni/>".
+// Optional queue group makes only one member of the group to receive a message.
+// Such messages are not sequenced, as each member gets only a part of them.
+// Without any, the node subscribes to all topics of its mappers.
+func (n *Ncd) AddTopicSubscription(pattern string, queue string) *Ncd {
+	n.topics = append(n.topics, &ncdtransport.TopicSubscription{Pattern: pattern, Queue: queue})
+	return n
+}
+
+// GetTransport returns NcdPubSub instance to setup NATS connection.
+// It is nil, if ncd is not running on NATS.
 func (n *Ncd) GetTransport() *ncdtransport.NcdPubSub {
 	return n.transport
 }
 
-// GetDBListener return PgEventListener instance
+// GetBus returns the bus, ncd is running on
+func (n *Ncd) GetBus() ncdtransport.Bus {
+	return n.bus
+}
+
+// GetDBListener return PgEventListener instance of the main Uyuni database
 func (n *Ncd) GetDBListener() *ncdtransport.PgEventListener {
-	return n.dbl
+	return n.dbls[0]
+}
+
+// AddDBListener adds a listener of another database source, e.g. reporting database.
+// The name is passed along with its events to the mapper.
+func (n *Ncd) AddDBListener(name string) *ncdtransport.PgEventListener {
+	dbl := ncdtransport.NewPgEventListener().SetName(name)
+	n.dbls = append(n.dbls, dbl)
+	return dbl
+}
+
+// GetDBListeners returns listeners of all database sources
+func (n *Ncd) GetDBListeners() []*ncdtransport.PgEventListener {
+	return n.dbls
+}
+
+// GetWireCodec returns WireCodec instance, used to encode messages for the bus
+func (n *Ncd) GetWireCodec() *ncdtransport.WireCodec {
+	return n.codec
+}
+
+// GetSigner returns MessageSigner instance, used to sign and verify messages
+func (n *Ncd) GetSigner() *ncdtransport.MessageSigner {
+	return n.signer
+}
+
+// SetSigner replaces the MessageSigner, e.g. to use another node name
+func (n *Ncd) SetSigner(signer *ncdtransport.MessageSigner) *Ncd {
+	n.signer = signer
+	n.director.SetSigner(signer)
+	n.objects.SetSigner(signer)
+	n.sequencer.SetSigner(signer)
+	for _, mobj := range n._mappers {
+		signer.AddLeaderTopic((*mobj).TopicRoot())
+	}
+	return n
+}
+
+// GetCipher returns PayloadCipher instance, used to encrypt sensitive payloads
+func (n *Ncd) GetCipher() *ncdtransport.PayloadCipher {
+	return n.cipher
+}
+
+// SetCipher replaces the PayloadCipher
+func (n *Ncd) SetCipher(cipher *ncdtransport.PayloadCipher) *Ncd {
+	n.cipher = cipher
+	return n
+}
+
+// GetSequencer returns Sequencer instance, used to detect and recover missed messages
+func (n *Ncd) GetSequencer() *ncdtransport.Sequencer {
+	return n.sequencer
+}
+
+// GetDeadLetters returns DeadLetterStore instance with the messages, failed to apply
+func (n *Ncd) GetDeadLetters() *ncdtransport.DeadLetterStore {
+	return n.deadletters
+}
+
+// GetTxAssembler returns TxAssembler instance, collecting messages of a transaction
+func (n *Ncd) GetTxAssembler() *ncdtransport.TxAssembler {
+	return n.txs
+}
+
+// RetryDeadLetter applies the dead letter again. On success it is removed from the store.
+// If the message is parked, eventmappers.ErrParked is returned and the dead letter is kept
+// until the message is actually applied.
+func (n *Ncd) RetryDeadLetter(id string) error {
+	letter, err := n.GetDeadLetters().Get(id)
+	if err != nil {
+		return err
+	}
+	msg, err := n.GetWireCodec().Decode(letter.Data)
+	if err != nil {
+		return err
+	}
+	if err := n.GetSigner().Verify(msg); err != nil {
+		return err
+	}
+	n.applying.Lock()
+	err = n.applyParkable(msg, letter.Data)
+	n.applying.Unlock()
+	if err == eventmappers.ErrParked {
+		return err
+	}
+	if err != nil {
+		if serr := n.GetDeadLetters().Put(msg, letter.Data, err); serr != nil {
+			log.Println("Cannot update dead letter:", serr.Error())
+		}
+		return err
+	}
+	return n.GetDeadLetters().Remove(id)
+}
+
+// GetDirector returns CdtTransport instance, handling commands of the director.
+// Register own commands with its OnCommand.
+func (n *Ncd) GetDirector() *ncdtransport.CdtTransport {
+	return n.director
+}
+
+// GetObjectTransfer returns ObjectTransfer instance to ship binary objects to the nodes
+func (n *Ncd) GetObjectTransfer() *ncdtransport.ObjectTransfer {
+	return n.objects
 }
 
 // IsRunning returns true, if the Ncd is already running
@@ -86,26 +262,313 @@ func (n *Ncd) SetLeader(leader bool) *Ncd {
 /////// Internal
 
 // Handles CHANNEL_NODES inbox
-func (n *Ncd) nodesHandler(m *nats.Msg) {
+func (n *Ncd) nodesHandler(m *ncdtransport.BusMsg) {
 	log.Println("NH: received", len(m.Data), "bytes")
-	msg := ncdtransport.NewMqMessage().FromBytes(m.Data)
-	if !n.reflector.Channel(CHANNEL_NODES).Discard(msg.Id) {
-		mapper, err := n.GetMapper(msg.Topic)
+	n.onNodesData(m.Subject, m.Data, true)
+}
+
+// Handles CHANNEL_NODES inbox of a queue group
+func (n *Ncd) nodesQueueHandler(m *ncdtransport.BusMsg) {
+	log.Println("NH: received", len(m.Data), "bytes from the queue")
+	n.onNodesData(m.Subject, m.Data, false)
+}
+
+// Process a received message on CHANNEL_NODES
+func (n *Ncd) onNodesData(subject string, data []byte, sequenced bool) {
+	msg, err := n.GetWireCodec().Decode(data)
+	if err != nil {
+		log.Println("NH: message rejected:", err.Error())
+		return
+	}
+	if n.reflector.Channel(CHANNEL_NODES).Discard(msg.Id) {
+		return
+	}
+	if err := n.GetSigner().Verify(msg); err != nil {
+		log.Println("NH: message rejected:", err.Error())
+		return
+	}
+	// Subscriptions are filtered by the subject, so it should be of the topic
+	if expected := ncdtransport.TopicToSubject(CHANNEL_NODES, msg.Topic); subject != expected {
+		log.Printf("NH: message %s rejected: topic '%s' is sent on subject %s instead of %s", msg.Id, msg.Topic, subject, expected)
+		return
+	}
+	// Late sequenced messages are recovered from the leader as a gap
+	if err := n.GetSigner().CheckReplay(msg); err != nil {
+		log.Println("NH: message rejected:", err.Error())
+		return
+	}
+	if sequenced {
+		n.sequence(msg, data)
+	} else {
+		n.deliver(msg, data)
+	}
+}
+
+// Deliver the message in order of its stream topic. If messages before it are missing,
+// they are recovered in background, while this and next messages of the topic are held.
+func (n *Ncd) sequence(msg *ncdtransport.MqMessage, data []byte) {
+	stream := msg.GetHeader(ncdtransport.HEADER_STREAM)
+	key := stream + msg.Topic
+
+	n.holding.Lock()
+	if held, ex := n.held[key]; ex {
+		n.held[key] = append(held, &ncdtransport.TxEntry{Msg: msg, Data: data})
+		n.holding.Unlock()
+		return
+	}
+	fresh, from, to := n.sequencer.Check(msg)
+	if !fresh {
+		n.holding.Unlock()
+		log.Println("NH: duplicate message", msg.Id, "dropped")
+		return
+	}
+	if from <= to {
+		n.held[key] = []*ncdtransport.TxEntry{{Msg: msg, Data: data}}
+		n.holding.Unlock()
+		go n.recover(stream, msg.Topic, from, to)
+		return
+	}
+	n.sequencer.Seen(msg)
+	n.holding.Unlock()
+
+	n.deliver(msg, data)
+}
+
+// Stream topic has missing messages, announced by the leader
+func (n *Ncd) onSeqGap(stream string, topic string, from int64, to int64) {
+	n.holding.Lock()
+	defer n.holding.Unlock()
+	if _, ex := n.held[stream+topic]; !ex {
+		n.held[stream+topic] = make([]*ncdtransport.TxEntry, 0)
+		go n.recover(stream, topic, from, to)
+	}
+}
+
+// Fetch the missing messages of the stream topic and deliver them, then the held ones
+func (n *Ncd) recover(stream string, topic string, from int64, to int64) {
+	n.fetchMissing(stream, topic, from, to)
+	for {
+		n.holding.Lock()
+		held := n.held[stream+topic]
+		if len(held) == 0 {
+			delete(n.held, stream+topic)
+			n.holding.Unlock()
+			return
+		}
+		n.held[stream+topic] = make([]*ncdtransport.TxEntry, 0)
+		n.holding.Unlock()
+
+		for _, entry := range held {
+			fresh, from, to := n.sequencer.Check(entry.Msg)
+			if !fresh {
+				continue
+			}
+			if from <= to {
+				n.fetchMissing(stream, topic, from, to)
+			}
+			n.sequencer.Seen(entry.Msg)
+			n.deliver(entry.Msg, entry.Data)
+		}
+	}
+}
+
+// Fetch the missing messages of the stream topic from the leader and deliver them
+func (n *Ncd) fetchMissing(stream string, topic string, from int64, to int64) {
+	log.Printf("NH: messages of '%s' [%d-%d] are missing, requesting them", topic, from, to)
+	missing, err := n.sequencer.Fetch(stream, topic, from, to)
+	if err != nil {
+		log.Println("NH:", err.Error())
+	}
+	for _, data := range missing {
+		msg, err := n.GetWireCodec().Decode(data)
+		if err == nil {
+			err = n.GetSigner().Verify(msg)
+		}
+		if err == nil && (msg.Topic != topic || msg.GetHeader(ncdtransport.HEADER_STREAM) != stream) {
+			err = fmt.Errorf("message %s is not of the requested stream topic", msg.Id)
+		}
+		if err != nil {
+			log.Println("NH: retransmitted message rejected:", err.Error())
+			continue
+		}
+		if fresh, _, _ := n.sequencer.Check(msg); fresh {
+			n.sequencer.Seen(msg)
+			n.deliver(msg, data)
+		}
+	}
+}
+
+// Hand the message over to its transaction, or apply it right away
+func (n *Ncd) deliver(msg *ncdtransport.MqMessage, data []byte) {
+	if !n.txs.Add(msg, data) {
+		n.applyTx([]*ncdtransport.TxEntry{{Msg: msg, Data: data}})
+	}
+}
+
+// Apply messages of a transaction in order. If the mapper accepts batches, it gets all of them at once.
+// Otherwise the first failed message stops the transaction, and the rest goes to dead letters with it.
+func (n *Ncd) applyTx(entries []*ncdtransport.TxEntry) {
+	n.applying.Lock()
+	defer n.applying.Unlock()
+
+	if len(entries) > 1 {
+		if err := n.applyBatch(entries); err != eventmappers.ErrBatchUnsupported {
+			if err != nil {
+				log.Println("NH: transaction", entries[0].Msg.GetHeader(ncdtransport.HEADER_TX), "failed, moved to dead letters:", err.Error())
+				n.deadLetters(entries, err)
+			}
+			return
+		}
+	}
+	for idx, entry := range entries {
+		err := n.applyParkable(entry.Msg, entry.Data)
+		if err == eventmappers.ErrParked {
+			log.Println("NH: message", entry.Msg.Id, "is parked")
+			continue
+		}
 		if err != nil {
-			panic(err)
+			log.Println("NH: message", entry.Msg.Id, "failed, moved to dead letters:", err.Error())
+			n.deadLetters(entries[idx:idx+1], err)
+			if idx+1 < len(entries) {
+				n.deadLetters(entries[idx+1:], fmt.Errorf("previous message %s of the transaction failed: %s", entry.Msg.Id, err.Error()))
+			}
+			return
+		}
+	}
+}
+
+// Apply messages of a transaction at once by their mapper, if it accepts batches
+func (n *Ncd) applyBatch(entries []*ncdtransport.TxEntry) error {
+	var receiver eventmappers.BatchReceiver
+	msgs := make([]*ncdtransport.MqMessage, 0, len(entries))
+	for _, entry := range entries {
+		mapper, err := n.GetMapper(entry.Msg.Topic)
+		if err != nil {
+			return eventmappers.ErrBatchUnsupported
+		}
+		batch, ok := (*(mapper)).(eventmappers.BatchReceiver)
+		if !ok || (receiver != nil && receiver != batch) {
+			return eventmappers.ErrBatchUnsupported
+		}
+		receiver = batch
+		msgs = append(msgs, entry.Msg)
+	}
+	for _, msg := range msgs {
+		if err := n.GetCipher().DecryptMessage(msg); err != nil {
+			return err
+		}
+	}
+	return receiver.OnMQBatch(msgs)
+}
+
+// Store failed messages as dead letters
+func (n *Ncd) deadLetters(entries []*ncdtransport.TxEntry, err error) {
+	for _, entry := range entries {
+		if serr := n.deadletters.Put(entry.Msg, entry.Data, err); serr != nil {
+			log.Println("NH: cannot store dead letter:", serr.Error())
 		}
-		(*(mapper)).OnMQReceive(msg)
 	}
 }
 
-// Handles CHANNELDIRECTOR inbox
-func (n *Ncd) controllerHandler(m *nats.Msg) {
-	fmt.Println("> from controller:", string(m.Data))
+// Apply the message. Its wire form is kept in advance, as the mapper may park it
+// and report its outcome later from another goroutine.
+func (n *Ncd) applyParkable(msg *ncdtransport.MqMessage, data []byte) error {
+	n.parking.Lock()
+	n.parked[msg.Id] = data
+	n.parking.Unlock()
+
+	err := n.applyMessage(msg)
+	if err != eventmappers.ErrParked {
+		n.parking.Lock()
+		delete(n.parked, msg.Id)
+		n.parking.Unlock()
+	}
+	return err
+}
+
+// Parked message is finally applied or has failed. Called by the mapper on applying or on its own retry.
+func (n *Ncd) onParked(msg *ncdtransport.MqMessage, err error) {
+	n.parking.Lock()
+	data, ex := n.parked[msg.Id]
+	delete(n.parked, msg.Id)
+	n.parking.Unlock()
+	if err != nil {
+		if !ex {
+			log.Println("NH: parked message", msg.Id, "failed and is lost:", err.Error())
+			return
+		}
+		n.deadLetters([]*ncdtransport.TxEntry{{Msg: msg, Data: data}}, err)
+		return
+	}
+	if _, lerr := n.deadletters.Get(msg.Id); lerr == nil {
+		if lerr = n.deadletters.Remove(msg.Id); lerr != nil {
+			log.Println("NH: cannot remove dead letter:", lerr.Error())
+		}
+	}
+}
+
+// Apply the message with its mapper
+func (n *Ncd) applyMessage(msg *ncdtransport.MqMessage) error {
+	if err := n.GetCipher().DecryptMessage(msg); err != nil {
+		return err
+	}
+	mapper, err := n.GetMapper(msg.Topic)
+	if err != nil {
+		return err
+	}
+	return (*(mapper)).OnMQReceive(msg)
+}
+
+// Director command "ping": node name and role
+func (n *Ncd) onPing(args map[string]interface{}) (interface{}, error) {
+	return map[string]interface{}{
+		"name":   n.GetSigner().Name(),
+		"leader": n.IsLeader(),
+		"bus":    n.GetBus().State().String(),
+	}, nil
+}
+
+// Director command "db.stats": worker pool metrics of each database source
+func (n *Ncd) onDBStats(args map[string]interface{}) (interface{}, error) {
+	stats := make(map[string]ncdtransport.PgWorkerStats)
+	for _, dbl := range n.GetDBListeners() {
+		stats[dbl.Name()] = dbl.GetWorkers().Stats()
+	}
+	return stats, nil
+}
+
+// Director command "deadletters.list": all dead letters of the node
+func (n *Ncd) onDeadLettersList(args map[string]interface{}) (interface{}, error) {
+	return n.GetDeadLetters().List()
+}
+
+// Director command "deadletters.retry": apply the dead letter by its "id" again
+func (n *Ncd) onDeadLettersRetry(args map[string]interface{}) (interface{}, error) {
+	id, ok := args["id"].(string)
+	if !ok || id == "" {
+		return nil, fmt.Errorf("argument 'id' is required")
+	}
+	return nil, n.RetryDeadLetter(id)
+}
+
+// Handles completely received objects
+func (n *Ncd) objectHandler(info *ncdtransport.ObjectInfo, path string) {
+	mapper, err := n.GetMapper(info.Topic)
+	if err != nil {
+		log.Println("Object", info.Name, "dropped:", err.Error())
+		return
+	}
+	receiver, ok := (*(mapper)).(eventmappers.ObjectReceiver)
+	if !ok {
+		log.Println("Object", info.Name, "dropped: mapper", (*(mapper)).Label(), "does not accept objects")
+		return
+	}
+	receiver.OnObjectReceive(info, path)
 }
 
 // XXX: Temporary handler for Uyuni Server database only. This should be moved to a plugin system.
-// Handles DB external events
-func (n *Ncd) externalHandler(m interface{}) {
+// Handles DB external events of one transaction
+func (n *Ncd) externalHandler(events []map[string]interface{}) {
 	// Get Uyuni handler to deal with the database messages
 	mpref, err := n.GetMapper("/uyuni")
 	if err != nil {
@@ -116,50 +579,129 @@ func (n *Ncd) externalHandler(m interface{}) {
 	switch (*(mpref)).Label() {
 	case "UyuniEventMapper":
 		uyuni := (*(mpref)).(*eventmappers.UyuniEventMapper)
-		msg := uyuni.OnIntReceive(ncdtransport.NewInternalEventMessage(m.(map[string]interface{})))
+		msgs := make([]*ncdtransport.MqMessage, 0, len(events))
+		for _, event := range events {
+			// send only supported topics
+			if msg := uyuni.OnIntReceive(ncdtransport.NewInternalEventMessage(event)); msg.Topic != "" {
+				msgs = append(msgs, msg)
+			}
+		}
 
-		// send only if the current node is a leader and topic is supported
-		if n.IsLeader() && msg.Topic != "" {
-			err := n.GetTransport().GetPublisher().Publish(CHANNEL_NODES, msg.ToBytes())
-			if err != nil {
-				log.Panicln("Publishing error:", err)
+		// send only if the current node is a leader
+		// A failed message does not stop the rest of the transaction: followers apply what they got
+		// after the timeout, and recover the retained messages as a gap.
+		if n.IsLeader() {
+			ncdtransport.StampTx(msgs)
+			for _, msg := range msgs {
+				if err := n.publish(msg); err != nil {
+					log.Println("EH: message", msg.Id, "of", msg.Topic, "is not sent:", err.Error())
+				}
 			}
-			n.reflector.Channel(CHANNEL_NODES).Push(msg.Id)
-			log.Println("EH: Published to", CHANNEL_NODES)
 		}
 	}
 }
 
-// Internal, actual start.
-func (n *Ncd) _start() {
-	if n.IsRunning() {
-		return
+// Publish the message to the nodes
+func (n *Ncd) publish(msg *ncdtransport.MqMessage) error {
+	if err := n.GetCipher().EncryptMessage(msg); err != nil {
+		return fmt.Errorf("cannot encrypt message: %s", err.Error())
 	}
 
-	// Setup MQ
-	n.GetTransport().Start()
-	var s1 *nats.Subscription
-	var s2 *nats.Subscription
-	var err error
-	s1, err = n.GetTransport().GetSubscriber().Subscribe(CHANNEL_NODES, n.nodesHandler)
-	if err != nil {
-		log.Panicln("Cannot subscribe to", CHANNEL_NODES, err.Error())
+	n.publishing.Lock()
+	defer n.publishing.Unlock()
+	n.sequencer.Stamp(msg)
+	if err := n.GetSigner().Sign(msg); err != nil {
+		n.sequencer.Unstamp(msg)
+		return fmt.Errorf("cannot sign message: %s", err.Error())
 	}
-	s2, err = n.GetTransport().GetSubscriber().Subscribe(CHANNEL_DIRECTOR, n.controllerHandler)
+	data, err := n.GetWireCodec().Encode(msg)
 	if err != nil {
-		log.Panicln("Cannot subscribe to", CHANNEL_DIRECTOR, err.Error())
+		n.sequencer.Unstamp(msg)
+		return fmt.Errorf("cannot encode message: %s", err.Error())
+	}
+	n.sequencer.Retain(msg, data)
+	subject := ncdtransport.TopicToSubject(CHANNEL_NODES, msg.Topic)
+	n.reflector.Channel(CHANNEL_NODES).Push(msg.Id)
+	if err := n.GetBus().Publish(subject, data); err != nil {
+		return fmt.Errorf("cannot publish message: %s", err.Error())
 	}
+	return nil
+}
 
-	fmt.Println(s1, s2)
+// Internal, actual start.
+func (n *Ncd) _start() {
+	if n.IsRunning() {
+		return
+	}
+	n.startBus()
 
 	// Setup Db listener and start it in background
 	// Dynamic design ideas:
 	//   1. Implement as a plugin
 	//   2. GetPlugins() -> []Plugin
 	//   3. For each apply map of callbacks, or one common that distinguishes the desinations etc
-	n.GetDBListener().AddCallback(n.externalHandler).Start()
-
+	for _, dbl := range n.GetDBListeners() {
+		name := dbl.Name()
+		dbl.AddBatchCallback(n.externalHandler).AddErrorCallback(func(err error) {
+			log.Println("DB", name+":", err.Error())
+		})
+	}
+	for _, dbl := range n.GetDBListeners()[1:] {
+		dbl.StartProcess()
+	}
 	n.rtconf.Running = true
+	n.GetDBListener().Start()
+}
+
+// Connect to the bus, subscribe to the channels and serve them
+func (n *Ncd) startBus() {
+	if n.GetSigner().PublicKey() == "" {
+		log.Panicln("Cannot start: node key is not loaded")
+	}
+
+	// Setup MQ
+	if err := n.GetBus().Start(); err != nil {
+		log.Panicln("Cannot connect to the bus:", err.Error())
+	}
+	if nats := n.GetTransport(); nats != nil {
+		n.GetWireCodec().SetMaxSize(nats.MaxPayload())
+	}
+	topics := n.topics
+	if len(topics) == 0 {
+		for _, mobj := range n._mappers {
+			topics = append(topics, &ncdtransport.TopicSubscription{Pattern: path.Join((*mobj).TopicRoot(), ">")})
+		}
+	}
+	for _, topic := range topics {
+		subject := ncdtransport.TopicToSubject(CHANNEL_NODES, topic.Pattern)
+		var err error
+		if topic.Queue != "" {
+			_, err = n.GetBus().QueueSubscribe(subject, topic.Queue, n.nodesQueueHandler)
+		} else {
+			_, err = n.GetBus().Subscribe(subject, n.nodesHandler)
+		}
+		if err != nil {
+			log.Panicln("Cannot subscribe to", subject, err.Error())
+		}
+		log.Println("Subscribed to", subject, topic.Queue)
+	}
+
+	if _, err := n.GetBus().Subscribe(CHANNEL_DIRECTOR, n.GetDirector().OnReceive); err != nil {
+		log.Panicln("Cannot subscribe to", CHANNEL_DIRECTOR, err.Error())
+	}
+
+	if n.IsLeader() {
+		if err := n.GetSequencer().Serve(); err != nil {
+			log.Panicln("Cannot serve retransmissions:", err.Error())
+		}
+	}
+	if err := n.GetSequencer().Follow(n.onSeqGap); err != nil {
+		log.Panicln("Cannot follow sequence announcements:", err.Error())
+	}
+
+	if err := n.GetObjectTransfer().AddCallback(n.objectHandler).Start(); err != nil {
+		log.Panicln("Cannot start object transfer:", err.Error())
+	}
 }
 
 // Run ncd in background
@@ -172,9 +714,12 @@ func (n *Ncd) Run() {
 	n._start()
 }
 
-// Stop ncd
+// Stop ncd. Database listeners finish the events they have.
 func (n *Ncd) Stop() {
-	if err := n.GetTransport().GetSubscriber().Drain(); err != nil {
+	for _, dbl := range n.GetDBListeners() {
+		dbl.Stop()
+	}
+	if err := n.GetBus().Drain(); err != nil {
 		panic("Drain error: " + err.Error())
 	}
 	n.rtconf.Running = false
@@ -0,0 +1,149 @@
+package ncd
+
+import (
+	"github.com/isbm/uyuni-ncd/transport"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Mapper, which passes received messages to the channel
+type recordingMapper struct {
+	received chan *ncdtransport.MqMessage
+}
+
+func (rm *recordingMapper) Label() string {
+	return "RecordingMapper"
+}
+
+func (rm *recordingMapper) TopicRoot() string {
+	return "/test"
+}
+
+func (rm *recordingMapper) OnMQReceive(m *ncdtransport.MqMessage) error {
+	rm.received <- m
+	return nil
+}
+
+func (rm *recordingMapper) OnIntReceive(m *ncdtransport.InternalEventMessage) *ncdtransport.MqMessage {
+	return nil
+}
+
+// Node on the broker with its own key and spool under the directory
+func newTestNode(t *testing.T, broker *ncdtransport.MemBroker, dir string, name string) (*Ncd, *recordingMapper) {
+	dir = filepath.Join(dir, name)
+	signer := ncdtransport.NewMessageSigner(name)
+	if err := ncdtransport.GenerateKey(filepath.Join(dir, "node.key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.LoadKey(filepath.Join(dir, "node.key")); err != nil {
+		t.Fatal(err)
+	}
+	mapper := &recordingMapper{received: make(chan *ncdtransport.MqMessage, 10)}
+	n := NewNcdWithBus(ncdtransport.NewMemBus(broker)).SetSigner(signer).AddMapper(mapper)
+	n.GetDeadLetters().SetDir(filepath.Join(dir, "deadletters"))
+	n.GetObjectTransfer().SetSpoolDir(filepath.Join(dir, "objects"))
+	return n, mapper
+}
+
+// Trust each other's keys, and the leader for the data topics
+func trustNodes(t *testing.T, leader *Ncd, followers ...*Ncd) {
+	nodes := append([]*Ncd{leader}, followers...)
+	for _, node := range nodes {
+		for _, other := range nodes {
+			if err := node.GetSigner().AddTrustedKey(other.GetSigner().Name(), other.GetSigner().PublicKey()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		node.GetSigner().AddLeader(leader.GetSigner().Name())
+	}
+}
+
+// Process all the messages, queued for the nodes
+func drain(t *testing.T, nodes ...*Ncd) {
+	for _, node := range nodes {
+		if err := node.GetBus().Drain(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemBusPublishApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker := ncdtransport.NewMemBroker()
+	leader, own := newTestNode(t, broker, dir, "leader")
+	follower, applied := newTestNode(t, broker, dir, "follower")
+	leader.SetLeader(true)
+	trustNodes(t, leader, follower)
+	leader.startBus()
+	follower.startBus()
+	defer leader.GetBus().Disconnect()
+	defer follower.GetBus().Disconnect()
+
+	msg := ncdtransport.NewMqMessage()
+	msg.Topic = "/test/item"
+	msg.Action = "insert"
+	msg.Payload = map[string]interface{}{"name": "first"}
+	if err := leader.publish(msg); err != nil {
+		t.Fatal(err)
+	}
+	// Published message is already in the inboxes: drained, it is processed
+	drain(t, leader, follower)
+
+	select {
+	case m := <-applied.received:
+		if m.Id != msg.Id || m.Topic != msg.Topic || m.Action != msg.Action {
+			t.Fatalf("applied %s %s %s, expected %s %s %s", m.Id, m.Topic, m.Action, msg.Id, msg.Topic, msg.Action)
+		}
+		if payload, _ := m.Payload.(map[string]interface{}); payload["name"] != "first" {
+			t.Fatalf("applied payload %v", m.Payload)
+		}
+	default:
+		t.Fatal("message is not applied on the follower")
+	}
+
+	select {
+	case m := <-own.received:
+		t.Fatalf("leader applied its own message %s", m.Id)
+	default:
+	}
+}
+
+func TestMemBusRejectsUntrustedLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker := ncdtransport.NewMemBroker()
+	leader, _ := newTestNode(t, broker, dir, "leader")
+	follower, applied := newTestNode(t, broker, dir, "follower")
+	leader.SetLeader(true)
+	trustNodes(t, follower, leader) // Follower is the only authorised leader
+	leader.startBus()
+	follower.startBus()
+	defer leader.GetBus().Disconnect()
+	defer follower.GetBus().Disconnect()
+
+	msg := ncdtransport.NewMqMessage()
+	msg.Topic = "/test/item"
+	msg.Action = "insert"
+	msg.Payload = map[string]interface{}{"name": "first"}
+	if err := leader.publish(msg); err != nil {
+		t.Fatal(err)
+	}
+	drain(t, follower)
+
+	select {
+	case m := <-applied.received:
+		t.Fatalf("message %s of a node, which is not a leader, is applied", m.Id)
+	default:
+	}
+}
@@ -1,16 +1,59 @@
+/*
+Director channel transport.
+
+Director sends commands to the nodes as JSON, signed by its key:
+
+	{"command": "<name>", "args": {...}, "signer": "<name>", "time": "<RFC 3339>", "signature": "<base64>"}
+
+Commands are accepted only from the signers, which are trusted and authorised
+as directors, and only once within the replay window (see MessageSigner).
+Each command has its own handler. If the message has a reply subject,
+the result of the handler or the error is replied back to the director:
+
+	{"command": "<name>", "result": ..., "error": "..."}
+
+Malformed messages and unknown commands are replied with an error as well.
+*/
+
 package ncdtransport
 
 import (
 	"encoding/json"
-	"github.com/nats-io/nats.go"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
+// CdtCallback is called on every valid command with the whole message
 type CdtCallback func(data map[string]interface{})
 
+// CdtCommandHandler handles a command with its arguments and returns the result for the reply
+type CdtCommandHandler func(args map[string]interface{}) (interface{}, error)
+
+// CdtCommand is a command from the director
+type CdtCommand struct {
+	Command   string                 `json:"command"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+	Signer    string                 `json:"signer,omitempty"`
+	Time      time.Time              `json:"time"`
+	Signature string                 `json:"signature,omitempty"`
+}
+
+// CdtReply is a reply to the director
+type CdtReply struct {
+	Command string      `json:"command,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
 type CdtTransport struct {
 	topic     string
+	bus       Bus
 	callbacks []CdtCallback
+	commands  map[string]CdtCommandHandler
+	signer    *MessageSigner
+	mtx       sync.RWMutex
 }
 
 // Constructor
@@ -18,18 +61,94 @@ func NewCdtTransport(topic string) *CdtTransport {
 	cdt := new(CdtTransport)
 	cdt.topic = topic
 	cdt.callbacks = make([]CdtCallback, 0)
+	cdt.commands = make(map[string]CdtCommandHandler)
+	return cdt
+}
+
+// SetBus sets the bus, where replies are sent
+func (cdt *CdtTransport) SetBus(bus Bus) {
+	cdt.bus = bus
+}
+
+// SetSigner sets the MessageSigner, verifying the commands. Without it all commands are rejected.
+func (cdt *CdtTransport) SetSigner(signer *MessageSigner) *CdtTransport {
+	cdt.mtx.Lock()
+	cdt.signer = signer
+	cdt.mtx.Unlock()
 	return cdt
 }
 
 // OnReceive is triggered by MQ when the message arrives
-func (cdt *CdtTransport) OnReceive(body *nats.Msg) {
-	var data interface{}
+func (cdt *CdtTransport) OnReceive(body *BusMsg) {
+	var data map[string]interface{}
+	cmd := new(CdtCommand)
 	if err := json.Unmarshal(body.Data, &data); err != nil {
-		log.Println("ERROR: wrong message body -", err.Error())
-	} else {
-		for _, callback := range cdt.callbacks {
-			callback(data.(map[string]interface{}))
+		cdt.reply(body, &CdtReply{Error: "malformed message: " + err.Error()})
+		return
+	}
+	if err := json.Unmarshal(body.Data, cmd); err != nil || cmd.Command == "" {
+		cdt.reply(body, &CdtReply{Error: "malformed message: no command"})
+		return
+	}
+
+	cdt.mtx.RLock()
+	handler, ex := cdt.commands[cmd.Command]
+	callbacks := cdt.callbacks
+	signer := cdt.signer
+	cdt.mtx.RUnlock()
+
+	if signer == nil {
+		cdt.reply(body, &CdtReply{Command: cmd.Command, Error: "commands cannot be verified"})
+		return
+	}
+	if err := signer.VerifyCommand(cmd); err != nil {
+		cdt.reply(body, &CdtReply{Command: cmd.Command, Error: err.Error()})
+		return
+	}
+
+	for _, callback := range callbacks {
+		callback(data)
+	}
+
+	if !ex {
+		cdt.reply(body, &CdtReply{Command: cmd.Command, Error: "unknown command"})
+		return
+	}
+	if cmd.Args == nil {
+		cmd.Args = make(map[string]interface{})
+	}
+	result, err := cdt.call(handler, cmd.Args)
+	reply := &CdtReply{Command: cmd.Command, Result: result}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	cdt.reply(body, reply)
+}
+
+// Call the command handler, turning its panic into an error
+func (cdt *CdtTransport) call(handler CdtCommandHandler, args map[string]interface{}) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("command failed: %v", r)
 		}
+	}()
+	return handler(args)
+}
+
+// Reply to the director, if it waits for the reply. Otherwise errors are logged.
+func (cdt *CdtTransport) reply(body *BusMsg, reply *CdtReply) {
+	if body.Reply == "" || cdt.bus == nil {
+		if reply.Error != "" {
+			log.Printf("ERROR: director command '%s' - %s", reply.Command, reply.Error)
+		}
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		data, _ = json.Marshal(&CdtReply{Command: reply.Command, Error: "cannot encode result: " + err.Error()})
+	}
+	if err := cdt.bus.Publish(body.Reply, data); err != nil {
+		log.Println("ERROR: cannot reply to director -", err.Error())
 	}
 }
 
@@ -39,6 +158,28 @@ func (cdt *CdtTransport) Topic() string {
 }
 
 // AddCallback adds an arbitrary callback, implementing transport.CdtCallback type.
-func (cdt *CdtTransport) AddCallback(callback CdtCallback) {
+func (cdt *CdtTransport) AddCallback(callback CdtCallback) *CdtTransport {
+	cdt.mtx.Lock()
 	cdt.callbacks = append(cdt.callbacks, callback)
+	cdt.mtx.Unlock()
+	return cdt
+}
+
+// OnCommand registers a handler of the command. Previous handler of the same command is replaced.
+func (cdt *CdtTransport) OnCommand(command string, handler CdtCommandHandler) *CdtTransport {
+	cdt.mtx.Lock()
+	cdt.commands[command] = handler
+	cdt.mtx.Unlock()
+	return cdt
+}
+
+// Commands returns names of the registered commands
+func (cdt *CdtTransport) Commands() []string {
+	cdt.mtx.RLock()
+	defer cdt.mtx.RUnlock()
+	names := make([]string, 0, len(cdt.commands))
+	for name := range cdt.commands {
+		names = append(names, name)
+	}
+	return names
 }
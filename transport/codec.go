@@ -0,0 +1,380 @@
+/*
+Wire codecs for the MqMessage.
+
+By default messages are plain JSON. Other encodings (MessagePack, Protobuf)
+and compression (gzip, zstd) are announced in a four bytes frame header:
+
+	0xff 'N' <codec id> <compression id>
+
+Decompressed message is limited to the maximal message size (the bus maximal
+payload), so a small compressed frame cannot exhaust the memory of the node.
+
+Messages without the header are JSON, so nodes with different codecs
+still understand each other: each node decodes whatever it receives and
+encodes with its own setup. Nodes before the versioned envelope do not
+understand the headers at all, see MQ_SCHEMA_VERSION.
+*/
+
+package ncdtransport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	CODEC_JSON     = "json"
+	CODEC_MSGPACK  = "msgpack"
+	CODEC_PROTOBUF = "protobuf"
+
+	COMPRESS_NONE = "none"
+	COMPRESS_GZIP = "gzip"
+	COMPRESS_ZSTD = "zstd"
+
+	frameMagic0 = 0xff
+	frameMagic1 = 'N'
+)
+
+// Codec encodes generic values (maps, slices, strings, numbers, booleans)
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// Compressor compresses encoded messages
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress data, failing if the result exceeds the limit in bytes
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// Identifiers in the frame header. Never change them, only add new.
+var codecIds = map[string]byte{CODEC_JSON: 0, CODEC_MSGPACK: 1, CODEC_PROTOBUF: 2}
+var compressIds = map[string]byte{COMPRESS_NONE: 0, COMPRESS_GZIP: 1, COMPRESS_ZSTD: 2}
+
+var codecs = map[byte]Codec{0: &jsonCodec{}, 1: &msgpackCodec{}, 2: &protobufCodec{}}
+var compressors = map[byte]Compressor{0: &noCompressor{}, 1: &gzipCompressor{}, 2: &zstdCompressor{}}
+
+// WireCodec encodes and decodes MqMessage for the bus
+type WireCodec struct {
+	codec     byte
+	compress  byte
+	threshold int
+	maxsize   int
+}
+
+func NewWireCodec() *WireCodec {
+	wc := new(WireCodec)
+	wc.codec = codecIds[CODEC_JSON]
+	wc.compress = compressIds[COMPRESS_NONE]
+	wc.threshold = 1024
+	wc.maxsize = 1024 * 1024
+	return wc
+}
+
+// SetCodec sets the encoding of the outgoing messages: "json", "msgpack" or "protobuf"
+func (wc *WireCodec) SetCodec(name string) error {
+	id, ex := codecIds[name]
+	if !ex {
+		return fmt.Errorf("unknown codec '%s'", name)
+	}
+	wc.codec = id
+	return nil
+}
+
+// SetCompression sets the compression of the outgoing messages: "none", "gzip" or "zstd"
+func (wc *WireCodec) SetCompression(name string) error {
+	id, ex := compressIds[name]
+	if !ex {
+		return fmt.Errorf("unknown compression '%s'", name)
+	}
+	wc.compress = id
+	return nil
+}
+
+// SetThreshold sets the minimal size of the encoded message in bytes to be compressed
+func (wc *WireCodec) SetThreshold(size int) *WireCodec {
+	wc.threshold = size
+	return wc
+}
+
+// SetMaxSize sets the maximal size of the encoded message before compression.
+// Default is 1 MB, as the NATS default maximal payload.
+func (wc *WireCodec) SetMaxSize(size int) *WireCodec {
+	if size > 0 {
+		wc.maxsize = size
+	}
+	return wc
+}
+
+// Encode the message for the wire
+func (wc *WireCodec) Encode(msg *MqMessage) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := wc.codec
+	if codec != codecIds[CODEC_JSON] {
+		var generic interface{}
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return nil, err
+		}
+		if data, err = codecs[codec].Marshal(generic); err != nil {
+			return nil, fmt.Errorf("%s encoding error: %s", codecs[codec].Name(), err.Error())
+		}
+	}
+
+	if len(data) > wc.maxsize {
+		return nil, fmt.Errorf("message %s is %d bytes, more than the maximum of %d", msg.Id, len(data), wc.maxsize)
+	}
+
+	compress := wc.compress
+	if len(data) < wc.threshold {
+		compress = compressIds[COMPRESS_NONE]
+	}
+	if codec == codecIds[CODEC_JSON] && compress == compressIds[COMPRESS_NONE] {
+		return data, nil // Plain JSON is understood by everyone
+	}
+	if data, err = compressors[compress].Compress(data); err != nil {
+		return nil, fmt.Errorf("%s compression error: %s", compressors[compress].Name(), err.Error())
+	}
+
+	return append([]byte{frameMagic0, frameMagic1, codec, compress}, data...), nil
+}
+
+// Decode the message from the wire, whatever codec it was encoded with
+func (wc *WireCodec) Decode(data []byte) (*MqMessage, error) {
+	if len(data) < 4 || data[0] != frameMagic0 || data[1] != frameMagic1 {
+		return NewMqMessage().FromBytes(data)
+	}
+
+	codec, ex := codecs[data[2]]
+	if !ex {
+		return nil, fmt.Errorf("message is encoded with unknown codec %d", data[2])
+	}
+	compressor, ex := compressors[data[3]]
+	if !ex {
+		return nil, fmt.Errorf("message is compressed with unknown method %d", data[3])
+	}
+
+	data, err := compressor.Decompress(data[4:], wc.maxsize)
+	if err != nil {
+		return nil, fmt.Errorf("%s decompression error: %s", compressor.Name(), err.Error())
+	}
+	if codec.Name() != CODEC_JSON {
+		generic, err := codec.Unmarshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s decoding error: %s", codec.Name(), err.Error())
+		}
+		if data, err = json.Marshal(generic); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewMqMessage().FromBytes(data)
+}
+
+///////////////// Codecs
+
+type jsonCodec struct{}
+
+func (c *jsonCodec) Name() string {
+	return CODEC_JSON
+}
+
+func (c *jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *jsonCodec) Unmarshal(data []byte) (interface{}, error) {
+	var v interface{}
+	return v, json.Unmarshal(data, &v)
+}
+
+type msgpackCodec struct{}
+
+func (c *msgpackCodec) Name() string {
+	return CODEC_MSGPACK
+}
+
+func (c *msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (c *msgpackCodec) Unmarshal(data []byte) (interface{}, error) {
+	var v interface{}
+	return v, msgpack.Unmarshal(data, &v)
+}
+
+// Protobuf codec encodes generic values as google.protobuf.Value
+type protobufCodec struct{}
+
+func (c *protobufCodec) Name() string {
+	return CODEC_PROTOBUF
+}
+
+func (c *protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	value, err := c.toValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(value)
+}
+
+func (c *protobufCodec) Unmarshal(data []byte) (interface{}, error) {
+	value := new(structpb.Value)
+	if err := proto.Unmarshal(data, value); err != nil {
+		return nil, err
+	}
+	return c.fromValue(value), nil
+}
+
+func (c *protobufCodec) toValue(v interface{}) (*structpb.Value, error) {
+	switch obj := v.(type) {
+	case nil:
+		return &structpb.Value{Kind: &structpb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}, nil
+	case bool:
+		return &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: obj}}, nil
+	case float64:
+		return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: obj}}, nil
+	case string:
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: obj}}, nil
+	case []interface{}:
+		list := &structpb.ListValue{Values: make([]*structpb.Value, 0, len(obj))}
+		for _, item := range obj {
+			value, err := c.toValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list.Values = append(list.Values, value)
+		}
+		return &structpb.Value{Kind: &structpb.Value_ListValue{ListValue: list}}, nil
+	case map[string]interface{}:
+		fields := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+		for key, item := range obj {
+			value, err := c.toValue(item)
+			if err != nil {
+				return nil, err
+			}
+			fields.Fields[key] = value
+		}
+		return &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: fields}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+func (c *protobufCodec) fromValue(value *structpb.Value) interface{} {
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return kind.BoolValue
+	case *structpb.Value_NumberValue:
+		return kind.NumberValue
+	case *structpb.Value_StringValue:
+		return kind.StringValue
+	case *structpb.Value_ListValue:
+		list := make([]interface{}, 0, len(kind.ListValue.GetValues()))
+		for _, item := range kind.ListValue.GetValues() {
+			list = append(list, c.fromValue(item))
+		}
+		return list
+	case *structpb.Value_StructValue:
+		obj := make(map[string]interface{})
+		for key, item := range kind.StructValue.GetFields() {
+			obj[key] = c.fromValue(item)
+		}
+		return obj
+	default:
+		return nil
+	}
+}
+
+///////////////// Compressors
+
+type noCompressor struct{}
+
+func (c *noCompressor) Name() string {
+	return COMPRESS_NONE
+}
+
+func (c *noCompressor) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (c *noCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	return data, nil
+}
+
+type gzipCompressor struct{}
+
+func (c *gzipCompressor) Name() string {
+	return COMPRESS_GZIP
+}
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	zw := gzip.NewWriter(&buff)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readLimited(zr, limit)
+}
+
+type zstdCompressor struct{}
+
+func (c *zstdCompressor) Name() string {
+	return COMPRESS_ZSTD
+}
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+	return zw.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readLimited(zr, limit)
+}
+
+// Read all the decompressed data, failing if there is more than the limit
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("decompressed message exceeds %d bytes", limit)
+	}
+	return data, nil
+}
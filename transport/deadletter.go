@@ -0,0 +1,148 @@
+/*
+Dead-letter store keeps messages, which failed to apply on this node,
+so they are not lost and can be inspected, retried or discarded later.
+
+Each dead letter is a JSON file in the store directory, named by the message Id.
+The message is kept in its wire form, exactly as it was received.
+*/
+
+package ncdtransport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DeadLetter struct {
+	Id       string
+	Topic    string
+	Action   string
+	Data     []byte
+	Error    string
+	Attempts int
+	Created  time.Time
+	Updated  time.Time
+}
+
+type DeadLetterStore struct {
+	dir string
+	mtx sync.Mutex
+}
+
+func NewDeadLetterStore(dir string) *DeadLetterStore {
+	dls := new(DeadLetterStore)
+	dls.dir = dir
+	return dls
+}
+
+// SetDir sets the directory of the store
+func (dls *DeadLetterStore) SetDir(dir string) *DeadLetterStore {
+	dls.dir = dir
+	return dls
+}
+
+// Put the failed message to the store. If it is already there, attempts are counted.
+func (dls *DeadLetterStore) Put(msg *MqMessage, data []byte, failure error) error {
+	dls.mtx.Lock()
+	defer dls.mtx.Unlock()
+
+	letter, err := dls.load(msg.Id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		letter = &DeadLetter{Id: msg.Id, Topic: msg.Topic, Action: msg.Action, Data: data, Created: time.Now()}
+	}
+	letter.Attempts++
+	letter.Error = failure.Error()
+	letter.Updated = time.Now()
+
+	return dls.save(letter)
+}
+
+// Get the dead letter by the message Id
+func (dls *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	dls.mtx.Lock()
+	defer dls.mtx.Unlock()
+
+	letter, err := dls.load(id)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no dead letter with Id %s", id)
+	}
+	return letter, err
+}
+
+// List all dead letters, oldest first
+func (dls *DeadLetterStore) List() ([]*DeadLetter, error) {
+	dls.mtx.Lock()
+	defer dls.mtx.Unlock()
+
+	letters := make([]*DeadLetter, 0)
+	matches, err := filepath.Glob(path.Join(dls.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fname := range matches {
+		id := filepath.Base(fname)
+		letter, err := dls.load(id[:len(id)-len(".json")])
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Created.Before(letters[j].Created) })
+
+	return letters, nil
+}
+
+// Remove the dead letter from the store
+func (dls *DeadLetterStore) Remove(id string) error {
+	dls.mtx.Lock()
+	defer dls.mtx.Unlock()
+
+	err := os.Remove(dls.letterPath(id))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no dead letter with Id %s", id)
+	}
+	return err
+}
+
+func (dls *DeadLetterStore) letterPath(id string) string {
+	return path.Join(dls.dir, filepath.Base(id)+".json")
+}
+
+// Load a dead letter. Requires lock.
+func (dls *DeadLetterStore) load(id string) (*DeadLetter, error) {
+	data, err := ioutil.ReadFile(dls.letterPath(id))
+	if err != nil {
+		return nil, err
+	}
+	letter := new(DeadLetter)
+	if err := json.Unmarshal(data, letter); err != nil {
+		return nil, fmt.Errorf("dead letter %s is broken: %s", id, err.Error())
+	}
+	return letter, nil
+}
+
+// Save a dead letter. Requires lock.
+func (dls *DeadLetterStore) save(letter *DeadLetter) error {
+	if err := os.MkdirAll(dls.dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := dls.letterPath(letter.Id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dls.letterPath(letter.Id))
+}
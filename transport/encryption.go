@@ -0,0 +1,421 @@
+/*
+End-to-end payload encryption for the sensitive topics.
+
+Payload is encrypted before the message is signed and sent, independently
+from the transport TLS, so neither bus operators nor other bus tenants can read it.
+Only the payload is encrypted: envelope (topic, action, headers) stays readable
+for the routing.
+
+Two modes are available per topic prefix:
+
+  - "cluster": payload is encrypted with a shared cluster key (AES-256-GCM).
+    Keyring may hold several keys: the current one encrypts, all of them decrypt.
+    Current key is set explicitly, otherwise it is the first key of the keyring,
+    so a new key is only accepted until the sender is switched over to it.
+    Key rotation is adding a new key to the keyring on every node, and then
+    making it current on the sender.
+
+  - "recipients": payload is encrypted with a random content key, which is then
+    sealed for every recipient node with its Curve25519 public key (NaCl box).
+*/
+
+package ncdtransport
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	HEADER_ENCRYPTION = "ncd-encryption"
+	HEADER_KEY_ID     = "ncd-key-id"
+
+	ENCRYPT_CLUSTER    = "cluster"
+	ENCRYPT_RECIPIENTS = "recipients"
+)
+
+// Encrypted payload as it goes in the MqMessage
+type EncryptedPayload struct {
+	Nonce      string
+	Ciphertext string
+	Sender     string            `json:",omitempty"` // Sender public key, recipients mode
+	Keys       map[string]string `json:",omitempty"` // Sealed content key per recipient node, recipients mode
+}
+
+type PayloadCipher struct {
+	name       string
+	topics     map[string]string // topic prefix to the mode
+	keyring    map[string][]byte
+	current    string
+	boxpub     *[32]byte
+	boxpriv    *[32]byte
+	recipients map[string]*[32]byte
+	mtx        sync.RWMutex
+}
+
+func NewPayloadCipher(name string) *PayloadCipher {
+	pc := new(PayloadCipher)
+	pc.name = name
+	pc.topics = make(map[string]string)
+	pc.keyring = make(map[string][]byte)
+	pc.recipients = make(map[string]*[32]byte)
+	return pc
+}
+
+// Encrypt sets the encryption mode for the topic prefix: "cluster" or "recipients"
+func (pc *PayloadCipher) Encrypt(prefix string, mode string) error {
+	if mode != ENCRYPT_CLUSTER && mode != ENCRYPT_RECIPIENTS {
+		return fmt.Errorf("unknown encryption mode '%s' for '%s'", mode, prefix)
+	}
+	pc.topics[prefix] = mode
+	return nil
+}
+
+// LoadKeyring loads cluster keys, one per line as "<key id> <base64 32 bytes key>".
+// The first key in the file is the current one, unless set otherwise.
+func (pc *PayloadCipher) LoadKeyring(fpath string) error {
+	if err := checkSecretFile("Keyring", fpath); err != nil {
+		return err
+	}
+	fh, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"<key id> <key>\"", fpath, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("%s:%d: key %s is not a valid 256 bit key", fpath, line, fields[0])
+		}
+		pc.keyring[fields[0]] = key
+		if pc.current == "" {
+			pc.current = fields[0]
+		}
+	}
+
+	return scanner.Err()
+}
+
+// SetCurrentKey sets the cluster key Id to encrypt with
+func (pc *PayloadCipher) SetCurrentKey(id string) error {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	if _, ex := pc.keyring[id]; !ex {
+		return fmt.Errorf("cluster key '%s' is not in the keyring", id)
+	}
+	pc.current = id
+	return nil
+}
+
+// RotateKeyring generates a new cluster key and appends it to the keyring file.
+// The new key is accepted on the next load of the keyring, but becomes current only when set so.
+func RotateKeyring(fpath string, id string) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(fpath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fh, "%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// GenerateBoxKey writes a new Curve25519 private key of the node. Existing key file is not overwritten.
+func GenerateBoxKey(fpath string) error {
+	_, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	return createSecretFile("Recipient key", fpath, []byte(base64.StdEncoding.EncodeToString(priv[:])+"\n"))
+}
+
+// LoadBoxKey loads Curve25519 private key of the node for the recipients mode
+func (pc *PayloadCipher) LoadBoxKey(fpath string) error {
+	if err := checkSecretFile("Recipient key", fpath); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("box key %s is not a valid Curve25519 key", fpath)
+	}
+	pc.boxpriv = new([32]byte)
+	copy(pc.boxpriv[:], key)
+	pc.boxpub = publicBoxKey(pc.boxpriv)
+
+	return nil
+}
+
+// BoxPublicKey returns base64-encoded Curve25519 public key of the node
+func (pc *PayloadCipher) BoxPublicKey() string {
+	if pc.boxpub == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(pc.boxpub[:])
+}
+
+// LoadRecipients loads public keys of the recipient nodes, one per line as "<node name> <base64 key>"
+func (pc *PayloadCipher) LoadRecipients(fpath string) error {
+	fh, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"<node name> <public key>\"", fpath, line)
+		}
+		if err := pc.AddRecipient(fields[0], fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: %s", fpath, line, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// AddRecipient adds base64-encoded Curve25519 public key of the recipient node
+func (pc *PayloadCipher) AddRecipient(name string, pubkey string) error {
+	key, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("public key of %s is not a valid Curve25519 key", name)
+	}
+	pub := new([32]byte)
+	copy(pub[:], key)
+
+	pc.mtx.Lock()
+	pc.recipients[name] = pub
+	pc.mtx.Unlock()
+	return nil
+}
+
+// Get encryption mode for the topic
+func (pc *PayloadCipher) mode(topic string) string {
+	prefixes := make([]string, 0, len(pc.topics))
+	for prefix := range pc.topics {
+		prefixes = append(prefixes, prefix)
+	}
+	// Longest prefix wins
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(topic, prefix) {
+			return pc.topics[prefix]
+		}
+	}
+	return ""
+}
+
+// EncryptMessage encrypts the payload, if the topic of the message requires so
+func (pc *PayloadCipher) EncryptMessage(msg *MqMessage) error {
+	mode := pc.mode(msg.Topic)
+	if mode == "" {
+		return nil
+	}
+	plaintext, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	pc.mtx.RLock()
+	defer pc.mtx.RUnlock()
+
+	payload := &EncryptedPayload{}
+	switch mode {
+	case ENCRYPT_CLUSTER:
+		key, ex := pc.keyring[pc.current]
+		if !ex {
+			return fmt.Errorf("topic '%s' requires cluster encryption, but no cluster key is loaded", msg.Topic)
+		}
+		if payload.Nonce, payload.Ciphertext, err = sealGCM(key, plaintext); err != nil {
+			return err
+		}
+		msg.SetHeader(HEADER_KEY_ID, pc.current)
+	case ENCRYPT_RECIPIENTS:
+		if pc.boxpriv == nil {
+			return errors.New("box key of the node is not loaded")
+		}
+		if len(pc.recipients) == 0 {
+			return fmt.Errorf("topic '%s' requires recipients encryption, but no recipients are known", msg.Topic)
+		}
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return err
+		}
+		if payload.Nonce, payload.Ciphertext, err = sealGCM(key, plaintext); err != nil {
+			return err
+		}
+		payload.Sender = pc.BoxPublicKey()
+		payload.Keys = make(map[string]string)
+		for name, pub := range pc.recipients {
+			var nonce [24]byte
+			if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+				return err
+			}
+			payload.Keys[name] = base64.StdEncoding.EncodeToString(box.Seal(nonce[:], key, &nonce, pub, pc.boxpriv))
+		}
+	}
+
+	msg.SetHeader(HEADER_ENCRYPTION, mode)
+	msg.Payload = payload
+	msg.raw = nil
+
+	return nil
+}
+
+// DecryptMessage decrypts the payload, if it is encrypted
+func (pc *PayloadCipher) DecryptMessage(msg *MqMessage) error {
+	mode := msg.GetHeader(HEADER_ENCRYPTION)
+	if mode == "" {
+		if pc.mode(msg.Topic) != "" {
+			return fmt.Errorf("message %s on topic '%s' should be encrypted, but it is not", msg.Id, msg.Topic)
+		}
+		return nil
+	}
+
+	payload := new(EncryptedPayload)
+	if err := msg.PayloadInto(payload); err != nil {
+		return err
+	}
+
+	pc.mtx.RLock()
+	defer pc.mtx.RUnlock()
+
+	var key []byte
+	switch mode {
+	case ENCRYPT_CLUSTER:
+		var ex bool
+		if key, ex = pc.keyring[msg.GetHeader(HEADER_KEY_ID)]; !ex {
+			return fmt.Errorf("message %s is encrypted with unknown cluster key '%s'", msg.Id, msg.GetHeader(HEADER_KEY_ID))
+		}
+	case ENCRYPT_RECIPIENTS:
+		sealed, ex := payload.Keys[pc.name]
+		if !ex || pc.boxpriv == nil {
+			return fmt.Errorf("message %s is not encrypted for this node", msg.Id)
+		}
+		data, err := base64.StdEncoding.DecodeString(sealed)
+		if err != nil || len(data) < 24 {
+			return fmt.Errorf("message %s has malformed content key", msg.Id)
+		}
+		sender, err := base64.StdEncoding.DecodeString(payload.Sender)
+		if err != nil || len(sender) != 32 {
+			return fmt.Errorf("message %s has malformed sender key", msg.Id)
+		}
+		var nonce [24]byte
+		var senderpub [32]byte
+		copy(nonce[:], data[:24])
+		copy(senderpub[:], sender)
+		if key, ex = box.Open(nil, data[24:], &nonce, &senderpub, pc.boxpriv); !ex {
+			return fmt.Errorf("message %s content key cannot be opened", msg.Id)
+		}
+	default:
+		return fmt.Errorf("message %s is encrypted with unknown mode '%s'", msg.Id, mode)
+	}
+
+	plaintext, err := openGCM(key, payload.Nonce, payload.Ciphertext)
+	if err != nil {
+		return fmt.Errorf("message %s cannot be decrypted: %s", msg.Id, err.Error())
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		return err
+	}
+	msg.Payload = data
+	msg.raw = plaintext
+	delete(msg.Headers, HEADER_ENCRYPTION)
+	delete(msg.Headers, HEADER_KEY_ID)
+
+	return nil
+}
+
+// Encrypt with AES-256-GCM, returns base64 nonce and ciphertext
+func sealGCM(key []byte, plaintext []byte) (string, string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)), nil
+}
+
+// Decrypt AES-256-GCM from base64 nonce and ciphertext
+func openGCM(key []byte, b64nonce string, b64ciphertext string) ([]byte, error) {
+	nonce, err := base64.StdEncoding.DecodeString(b64nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(b64ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("wrong nonce size")
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// Derive Curve25519 public key from the private
+func publicBoxKey(priv *[32]byte) *[32]byte {
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return pub
+}
@@ -0,0 +1,312 @@
+/*
+Apply queue makes sure replicated entities are applied in the order of their dependencies.
+
+Messages may arrive in any order: a child channel may come before its parent,
+or a repository association before the repository itself. Each message
+declares what entities it requires and what entities it provides. Entity is
+referred by a key as "<kind>:<id>", e.g. "channel:sles15-sp1-pool-x86_64".
+
+If any required entity is neither applied by the queue before, nor exists on
+the node, the message is parked and ErrParked is returned. Parked messages are
+retried each time something was successfully applied, and periodically while
+there are any, as the entities may appear on the node by other means. Their
+outcome is reported to the parked callback. Messages dropped due to the parking
+limit are reported as failed.
+
+Entities, which are not on the node, are looked up again only after the
+recheck interval, outside the queue lock, as the lookup may be remote.
+Entities, known to be on the node, are forgotten once removed by a message,
+or after the expiry, and are looked up again then.
+*/
+
+package eventmappers
+
+import (
+	"fmt"
+	"github.com/isbm/uyuni-ncd/transport"
+	"log"
+	"sync"
+	"time"
+)
+
+// DependencyFunc returns entity keys, which are required or provided by the message
+type DependencyFunc func(m *ncdtransport.MqMessage) []string
+
+// ExistsFunc checks if an entity is already present on the node
+type ExistsFunc func(key string) bool
+
+type ApplyQueue struct {
+	apply     ActionFunc
+	exists    ExistsFunc
+	requires  map[string]DependencyFunc
+	provides  map[string]DependencyFunc
+	removes   map[string]DependencyFunc
+	applied   map[string]time.Time // Entities on the node, when they were known to be there
+	absent    map[string]time.Time // Last lookup of the missing entities
+	recheck   time.Duration
+	expiry    time.Duration
+	pruned    time.Time
+	parked    []*ncdtransport.MqMessage
+	maxparked int
+	retry     time.Duration
+	timer     *time.Timer // Retry of the parked messages, while there are any
+	onparked  ParkedCallback
+	mtx       sync.Mutex
+}
+
+func NewApplyQueue(apply ActionFunc) *ApplyQueue {
+	aq := new(ApplyQueue)
+	aq.apply = apply
+	aq.exists = func(key string) bool { return false }
+	aq.requires = make(map[string]DependencyFunc)
+	aq.provides = make(map[string]DependencyFunc)
+	aq.removes = make(map[string]DependencyFunc)
+	aq.applied = make(map[string]time.Time)
+	aq.absent = make(map[string]time.Time)
+	aq.recheck = 30 * time.Second
+	aq.expiry = time.Hour
+	aq.pruned = time.Now()
+	aq.parked = make([]*ncdtransport.MqMessage, 0)
+	aq.maxparked = 1000
+	aq.retry = time.Minute
+	aq.onparked = func(m *ncdtransport.MqMessage, err error) {}
+
+	return aq
+}
+
+// SetExistsFunc sets a function that looks up entities, which were not applied by the queue.
+func (aq *ApplyQueue) SetExistsFunc(exists ExistsFunc) *ApplyQueue {
+	aq.exists = exists
+	return aq
+}
+
+// SetRecheckInterval sets how long a missing entity is not looked up again. Default is 30 seconds.
+func (aq *ApplyQueue) SetRecheckInterval(interval time.Duration) *ApplyQueue {
+	aq.recheck = interval
+	return aq
+}
+
+// SetExpiry sets for how long an entity, known to be on the node, is not looked up again. Default is 1 hour.
+func (aq *ApplyQueue) SetExpiry(expiry time.Duration) *ApplyQueue {
+	if expiry > 0 {
+		aq.expiry = expiry
+	}
+	return aq
+}
+
+// SetRetryInterval sets how often parked messages are retried without new submits. Default is 1 minute.
+func (aq *ApplyQueue) SetRetryInterval(interval time.Duration) *ApplyQueue {
+	if interval > 0 {
+		aq.retry = interval
+	}
+	return aq
+}
+
+// SetMaxParked limits how many messages can wait for their prerequisites. Oldest are dropped first.
+func (aq *ApplyQueue) SetMaxParked(max int) *ApplyQueue {
+	aq.maxparked = max
+	return aq
+}
+
+// SetParkedCallback sets a callback, called when a parked message is finally applied, has failed or is dropped.
+// It is called with the queue lock held, so it must not submit anything. It is called on submit,
+// or on the retry from another goroutine.
+func (aq *ApplyQueue) SetParkedCallback(callback ParkedCallback) *ApplyQueue {
+	aq.onparked = callback
+	return aq
+}
+
+// Requires sets a dependency function for the topic to find out required entities
+func (aq *ApplyQueue) Requires(topic string, deps DependencyFunc) *ApplyQueue {
+	aq.requires[topic] = deps
+	return aq
+}
+
+// Provides sets a dependency function for the topic to find out entities, which appear after the message is applied
+func (aq *ApplyQueue) Provides(topic string, deps DependencyFunc) *ApplyQueue {
+	aq.provides[topic] = deps
+	return aq
+}
+
+// Removes sets a dependency function for the topic to find out entities, which are gone after the message is applied
+func (aq *ApplyQueue) Removes(topic string, deps DependencyFunc) *ApplyQueue {
+	aq.removes[topic] = deps
+	return aq
+}
+
+// Parked returns the amount of messages, waiting for their prerequisites
+func (aq *ApplyQueue) Parked() int {
+	aq.mtx.Lock()
+	defer aq.mtx.Unlock()
+	return len(aq.parked)
+}
+
+// Submit a message to apply. If its prerequisites are missing, the message is parked and ErrParked is returned.
+func (aq *ApplyQueue) Submit(m *ncdtransport.MqMessage) error {
+	aq.lookup(m)
+
+	aq.mtx.Lock()
+	defer aq.mtx.Unlock()
+	aq.prune()
+
+	if missing := aq.missing(m); len(missing) > 0 {
+		aq.park(m, missing)
+		aq.retryParked() // Some could appear on the node meanwhile
+		return ErrParked
+	}
+	if err := aq.run(m); err != nil {
+		return err
+	}
+	aq.retryParked()
+
+	return nil
+}
+
+// Apply the message and register provided and removed entities. Requires lock.
+func (aq *ApplyQueue) run(m *ncdtransport.MqMessage) error {
+	if err := aq.apply(m); err != nil {
+		return err
+	}
+	if deps, ex := aq.provides[m.Topic]; ex {
+		for _, key := range deps(m) {
+			aq.applied[key] = time.Now()
+			delete(aq.absent, key)
+		}
+	}
+	if deps, ex := aq.removes[m.Topic]; ex {
+		for _, key := range deps(m) {
+			delete(aq.applied, key)
+		}
+	}
+	return nil
+}
+
+// Retry the parked messages periodically, while there are any
+func (aq *ApplyQueue) onRetry() {
+	aq.lookup(nil)
+
+	aq.mtx.Lock()
+	defer aq.mtx.Unlock()
+	aq.timer = nil
+	aq.prune()
+	aq.retryParked()
+}
+
+// Forget expired entities, and lookups of the missing ones, which are due anyway. Requires lock.
+func (aq *ApplyQueue) prune() {
+	if time.Since(aq.pruned) < aq.expiry {
+		return
+	}
+	for key, at := range aq.applied {
+		if time.Since(at) >= aq.expiry {
+			delete(aq.applied, key)
+		}
+	}
+	for key, checked := range aq.absent {
+		if time.Since(checked) >= aq.recheck {
+			delete(aq.absent, key)
+		}
+	}
+	aq.pruned = time.Now()
+}
+
+// Retry parked messages until nothing else can be applied. Requires lock.
+func (aq *ApplyQueue) retryParked() {
+	for progress := true; progress; {
+		progress = false
+		waiting := make([]*ncdtransport.MqMessage, 0, len(aq.parked))
+		for _, m := range aq.parked {
+			if len(aq.missing(m)) > 0 {
+				waiting = append(waiting, m)
+				continue
+			}
+			err := aq.run(m)
+			if err != nil {
+				log.Printf("Parked message %s on topic %s failed: %s", m.Id, m.Topic, err.Error())
+			} else {
+				log.Printf("Parked message %s on topic %s has been applied", m.Id, m.Topic)
+			}
+			aq.onparked(m, err)
+			progress = true
+		}
+		aq.parked = waiting
+	}
+	if len(aq.parked) > 0 && aq.timer == nil {
+		aq.timer = time.AfterFunc(aq.retry, aq.onRetry)
+	}
+}
+
+// Park the message. Requires lock.
+func (aq *ApplyQueue) park(m *ncdtransport.MqMessage, missing []string) {
+	for _, parked := range aq.parked {
+		if parked.Id == m.Id {
+			return // Retried while still waiting
+		}
+	}
+	log.Printf("Message %s on topic %s is parked, waiting for %v", m.Id, m.Topic, missing)
+	aq.parked = append(aq.parked, m)
+	if aq.maxparked > 0 && len(aq.parked) > aq.maxparked {
+		dropped := aq.parked[0]
+		aq.parked = aq.parked[1:]
+		log.Printf("Too many parked messages, dropping %s on topic %s", dropped.Id, dropped.Topic)
+		aq.onparked(dropped, fmt.Errorf("dropped from %d parked messages", aq.maxparked))
+	}
+}
+
+// Required entities of the message
+func (aq *ApplyQueue) required(m *ncdtransport.MqMessage) []string {
+	if deps, ex := aq.requires[m.Topic]; ex {
+		return deps(m)
+	}
+	return []string{}
+}
+
+// Look up the unknown entities, required by the message, if any, and the parked ones, without holding the lock
+func (aq *ApplyQueue) lookup(m *ncdtransport.MqMessage) {
+	aq.mtx.Lock()
+	msgs := aq.parked
+	if m != nil {
+		msgs = append([]*ncdtransport.MqMessage{m}, msgs...)
+	}
+	unknown := make([]string, 0)
+	for _, msg := range msgs {
+		for _, key := range aq.required(msg) {
+			if checked, ex := aq.absent[key]; !aq.known(key) && (!ex || time.Since(checked) >= aq.recheck) {
+				aq.absent[key] = time.Now() // Once per key
+				unknown = append(unknown, key)
+			}
+		}
+	}
+	aq.mtx.Unlock()
+
+	for _, key := range unknown {
+		if aq.exists(key) {
+			aq.mtx.Lock()
+			aq.applied[key] = time.Now()
+			delete(aq.absent, key)
+			aq.mtx.Unlock()
+		}
+	}
+}
+
+// Get the list of the required entities that are not yet on the node. Requires lock.
+func (aq *ApplyQueue) missing(m *ncdtransport.MqMessage) []string {
+	missing := make([]string, 0)
+	for _, key := range aq.required(m) {
+		if !aq.known(key) {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// Returns true, if the entity is known to be on the node and is not expired. Requires lock.
+func (aq *ApplyQueue) known(key string) bool {
+	at, ex := aq.applied[key]
+	return ex && time.Since(at) < aq.expiry
+}
+
+// EntityKey formats an entity key of a given kind
+func EntityKey(kind string, id interface{}) string {
+	return fmt.Sprintf("%s:%v", kind, id)
+}
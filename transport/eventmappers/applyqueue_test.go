@@ -0,0 +1,89 @@
+package eventmappers
+
+import (
+	"github.com/isbm/uyuni-ncd/transport"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Message, which provides, requires or removes the entities of its payload
+func entityMessage(action string, provides string, requires string) *ncdtransport.MqMessage {
+	msg := ncdtransport.NewMqMessage()
+	msg.Topic = "/test/entity"
+	msg.Action = action
+	msg.Payload = []string{provides, requires}
+	return msg
+}
+
+func entityDeps(idx int, action string) DependencyFunc {
+	return func(m *ncdtransport.MqMessage) []string {
+		var keys []string
+		if err := m.PayloadInto(&keys); err != nil || m.Action != action || keys[idx] == "" {
+			return []string{}
+		}
+		return []string{keys[idx]}
+	}
+}
+
+func newEntityQueue() *ApplyQueue {
+	return NewApplyQueue(func(m *ncdtransport.MqMessage) error { return nil }).
+		Provides("/test/entity", entityDeps(0, "update")).
+		Requires("/test/entity", entityDeps(1, "update")).
+		Removes("/test/entity", entityDeps(0, "delete"))
+}
+
+func TestApplyQueueRemovesDeleted(t *testing.T) {
+	aq := newEntityQueue()
+	if err := aq.Submit(entityMessage("update", "parent", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := aq.Submit(entityMessage("update", "child", "parent")); err != nil {
+		t.Fatal(err)
+	}
+	if err := aq.Submit(entityMessage("delete", "parent", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := aq.Submit(entityMessage("update", "other", "parent")); err != ErrParked {
+		t.Fatalf("message, requiring a deleted entity, is not parked: %v", err)
+	}
+}
+
+func TestApplyQueueRetriesParked(t *testing.T) {
+	var present bool
+	var mtx sync.Mutex
+	applied := make(chan *ncdtransport.MqMessage, 1)
+	aq := newEntityQueue().SetRetryInterval(10 * time.Millisecond).SetRecheckInterval(0).
+		SetExistsFunc(func(key string) bool {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return present
+		}).
+		SetParkedCallback(func(m *ncdtransport.MqMessage, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			applied <- m
+		})
+
+	msg := entityMessage("update", "child", "parent")
+	if err := aq.Submit(msg); err != ErrParked {
+		t.Fatalf("message is not parked: %v", err)
+	}
+
+	// Parent appears on the node by other means, nothing is submitted anymore
+	mtx.Lock()
+	present = true
+	mtx.Unlock()
+	select {
+	case m := <-applied:
+		if m.Id != msg.Id {
+			t.Fatalf("applied %s instead of %s", m.Id, msg.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("parked message is not retried")
+	}
+	if aq.Parked() != 0 {
+		t.Fatalf("%d messages are still parked", aq.Parked())
+	}
+}
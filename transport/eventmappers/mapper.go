@@ -1,12 +1,41 @@
 package eventmappers
 
 import (
+	"errors"
+
 	"github.com/isbm/uyuni-ncd/transport"
 )
 
 type Mapper interface {
 	Label() string
 	TopicRoot() string
-	OnMQReceive(m *ncdtransport.MqMessage)
+	OnMQReceive(m *ncdtransport.MqMessage) error
 	OnIntReceive(m *ncdtransport.InternalEventMessage) *ncdtransport.MqMessage
 }
+
+// ObjectReceiver is optionally implemented by the mappers,
+// which are accepting binary objects (packages, files etc) from the bus.
+type ObjectReceiver interface {
+	OnObjectReceive(info *ncdtransport.ObjectInfo, path string)
+}
+
+// ErrBatchUnsupported is returned, if the messages cannot be applied as a batch
+var ErrBatchUnsupported = errors.New("batch is not supported")
+
+// BatchReceiver is optionally implemented by the mappers, which apply messages
+// of one transaction at once: atomically, or compensating the applied ones on failure.
+// Otherwise messages are applied one by one, in order.
+type BatchReceiver interface {
+	OnMQBatch(msgs []*ncdtransport.MqMessage) error
+}
+
+// ErrParked is returned, if the message waits for its prerequisites and will be applied later
+var ErrParked = errors.New("message is parked, waiting for its prerequisites")
+
+// ParkedCallback is called, once a parked message is finally applied (err is nil), has failed or is dropped
+type ParkedCallback func(m *ncdtransport.MqMessage, err error)
+
+// ParkingReceiver is optionally implemented by the mappers, which park messages.
+type ParkingReceiver interface {
+	OnParked(callback ParkedCallback)
+}
@@ -1,8 +1,11 @@
 package eventmappers
 
 import (
+	"context"
 	"fmt"
 	"github.com/isbm/uyuni-ncd/transport"
+	"github.com/isbm/uyuni-ncd/uyuni"
+	"log"
 )
 
 type ActionFunc func(m *ncdtransport.MqMessage) error
@@ -10,6 +13,7 @@ type ActionFunc func(m *ncdtransport.MqMessage) error
 type UyuniActionsMap struct {
 	mapper *UyuniEventMapper
 	fmap   map[string]ActionFunc
+	queue  *ApplyQueue
 }
 
 func NewUyuniActionsMap(uem *UyuniEventMapper) *UyuniActionsMap {
@@ -18,10 +22,21 @@ func NewUyuniActionsMap(uem *UyuniEventMapper) *UyuniActionsMap {
 	uam.fmap = map[string]ActionFunc{
 		"/uyuni/rhnchannel": uam.onRhnChannel,
 	}
+	ncdtransport.RegisterPayloadType("/uyuni/rhnchannel", uyuni.Channel{})
+	uam.queue = NewApplyQueue(uam.dispatch).SetExistsFunc(uem.entityExists).
+		Requires("/uyuni/rhnchannel", uam.requiresRhnChannel).
+		Provides("/uyuni/rhnchannel", uam.providesRhnChannel).
+		Removes("/uyuni/rhnchannel", uam.removesRhnChannel)
 	return uam
 }
 
+// OnTopic applies the message, once all its prerequisites are on the node
 func (uam *UyuniActionsMap) OnTopic(m *ncdtransport.MqMessage) error {
+	return uam.queue.Submit(m)
+}
+
+// Call an action, mapped to the message topic
+func (uam *UyuniActionsMap) dispatch(m *ncdtransport.MqMessage) error {
 	call, ex := uam.fmap[m.Topic]
 	if !ex {
 		return fmt.Errorf("No actionable topic '%s' has been found", m.Topic)
@@ -40,22 +55,67 @@ func (uam *UyuniActionsMap) onRhnChannel(m *ncdtransport.MqMessage) error {
 		switch m.Action {
 		case "update":
 			fmt.Println("Action", m.Action)
-			args := make([]interface{}, 0)
-
-			for _, arg := range []string{"label", "name", "summary", "arch_label",
-				"parent_channel_label", "checksum_label", "gpgkey", "gpg_check"} {
-				if arg == "gpgkey" {
-					args = append(args, map[string]interface{}{
-						"url":         m.Payload.(map[string]interface{})["gpg_key_url"],
-						"id":          m.Payload.(map[string]interface{})["gpg_key_id"],
-						"fingerprint": m.Payload.(map[string]interface{})["gpg_key_fp"],
-					})
-				} else {
-					args = append(args, m.Payload.(map[string]interface{})[arg])
-				}
+			channel, err := uam.channel(m)
+			if err != nil {
+				return err
+			}
+			err = uam.mapper.GetAPI().CreateChannel(context.Background(), channel)
+			if uyuni.IsAlreadyExists(err) {
+				log.Println("Channel", channel.Label, "is already there")
+				return nil
 			}
-			fmt.Println("Return on channel.software.create:", uam.mapper.scall("channel.software.create", args...))
+			return err
 		}
 	}
 	return nil
 }
+
+// Channel details from the message payload
+func (uam *UyuniActionsMap) channel(m *ncdtransport.MqMessage) (*uyuni.Channel, error) {
+	payload, err := m.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+	channel, ok := payload.(*uyuni.Channel)
+	if !ok || channel.Label == "" {
+		return nil, fmt.Errorf("Message %s on topic '%s' has no channel label", m.Id, m.Topic)
+	}
+	return channel, nil
+}
+
+// Channel requires its parent channel
+func (uam *UyuniActionsMap) requiresRhnChannel(m *ncdtransport.MqMessage) []string {
+	deps := make([]string, 0)
+	if m.Action != "update" {
+		return deps
+	}
+	if channel, err := uam.channel(m); err == nil && channel.ParentChannelLabel != "" {
+		deps = append(deps, EntityKey("channel", channel.ParentChannelLabel))
+	}
+	return deps
+}
+
+// Channel provides itself
+func (uam *UyuniActionsMap) providesRhnChannel(m *ncdtransport.MqMessage) []string {
+	deps := make([]string, 0)
+	if m.Action != "update" {
+		return deps
+	}
+	if channel, err := uam.channel(m); err == nil {
+		deps = append(deps, EntityKey("channel", channel.Label))
+	}
+	return deps
+}
+
+// Deleted channel is gone
+func (uam *UyuniActionsMap) removesRhnChannel(m *ncdtransport.MqMessage) []string {
+	deps := make([]string, 0)
+	if m.Action != "delete" {
+		return deps
+	}
+	var label string
+	if err := m.PayloadInto(&label); err == nil && label != "" {
+		deps = append(deps, EntityKey("channel", label))
+	}
+	return deps
+}
@@ -6,12 +6,15 @@ from the Uyuni Server on certain events and prepare a payload for the MQ Message
 package eventmappers
 
 import (
+	"context"
 	"fmt"
 	"github.com/isbm/uyuni-ncd/transport"
 	"log"
+	"path"
 )
 
-type MapFunc func(action string, data map[string]interface{}) interface{}
+// MapFunc returns the payload of the event. Nil payload is not sent.
+type MapFunc func(action string, data map[string]interface{}) (interface{}, error)
 
 type UyuniIntMap struct {
 	mapper *UyuniEventMapper
@@ -27,29 +30,45 @@ func NewUyuniIntMap(uem *UyuniEventMapper) *UyuniIntMap {
 	return uim
 }
 
+// Topic of the event, relative to the mapper root. Tables of the main Uyuni database
+// are topics as is, tables of the other sources are "<source>/<table>".
+func (uim *UyuniIntMap) Topic(m *ncdtransport.InternalEventMessage) string {
+	if m.Source == "" || m.Source == ncdtransport.PG_DEFAULT_SOURCE {
+		return m.Topic
+	}
+	return path.Join(m.Source, m.Topic)
+}
+
 func (uim *UyuniIntMap) OnTopic(m *ncdtransport.InternalEventMessage) (interface{}, error) {
-	call, ex := uim.fmap[m.Topic]
+	call, ex := uim.fmap[uim.Topic(m)]
 	if !ex {
-		return nil, fmt.Errorf("No topic '%s' has been found", m.Topic)
+		return nil, fmt.Errorf("No topic '%s' has been found", uim.Topic(m))
 	}
 
-	return call(m.Action, m.Payload), nil
+	payload, err := call(m.Action, m.Payload)
+	if err == nil && payload == nil {
+		err = fmt.Errorf("nothing to send on %s", m.Action)
+	}
+	return payload, err
 }
 
 ///////////////// Mappers
 
 // Action for "rhnchannel" table
-func (uim *UyuniIntMap) onRhnChannel(action string, data map[string]interface{}) interface{} {
-	var out interface{}
+func (uim *UyuniIntMap) onRhnChannel(action string, data map[string]interface{}) (interface{}, error) {
 	switch action {
 	case "insert":
 		// Explicitly ignore. It is always an update afterwards.
 	case "update":
-		out = uim.mapper.scall("channel.software.getDetails", data["label"].(string))
+		label, ok := data["label"].(string)
+		if !ok {
+			return nil, fmt.Errorf("channel update without label")
+		}
+		return uim.mapper.GetAPI().GetChannelDetails(context.Background(), label)
 	case "delete":
-		out = data["label"]
+		return data["label"], nil
 	default:
 		log.Println("No destination defined on action", action)
 	}
-	return out
+	return nil, nil
 }
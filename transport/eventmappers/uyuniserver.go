@@ -14,34 +14,32 @@ reflect on the rest of the cluster.
 package eventmappers
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"github.com/isbm/uyuni-ncd/transport"
-	"github.com/kolo/xmlrpc"
+	"github.com/isbm/uyuni-ncd/uyuni"
 	"log"
-	"net/http"
 	"path"
 	"reflect"
+	"strings"
+	"time"
 )
 
 // Used to convert in-messages from Uyuni server to out for cluster
 type UyuniEventMapper struct {
-	_rpc     *xmlrpc.Client
-	_url     string
-	_tls     bool
-	_user    string
-	_pwd     string
-	_session string
-	intmap   *UyuniIntMap
-	actmap   *UyuniActionsMap
-	index    map[string]interface{} // For now, at the beginning.
+	_api   *uyuni.Client
+	_user  string
+	_pwd   string
+	intmap *UyuniIntMap
+	actmap *UyuniActionsMap
+	index  map[string]interface{} // For now, at the beginning.
 	// Then should be its own type.
 	// Used to know what is at boot time in Uyuni
 }
 
 func NewUyuniEventMapper() *UyuniEventMapper {
 	uem := new(UyuniEventMapper)
-	uem._tls = true
+	uem._api = uyuni.NewClient("")
 	uem.index = make(map[string]interface{})
 	uem.intmap = NewUyuniIntMap(uem)
 	uem.actmap = NewUyuniActionsMap(uem)
@@ -63,11 +61,14 @@ func (uem *UyuniEventMapper) TopicRoot() string {
 }
 
 // OnReceive tells what to do, once message came from the MQ bus
-func (uem *UyuniEventMapper) OnMQReceive(m *ncdtransport.MqMessage) {
+func (uem *UyuniEventMapper) OnMQReceive(m *ncdtransport.MqMessage) error {
 	fmt.Println("Uyuni mapper received message:", m.Topic)
-	if err := uem.actmap.OnTopic(m); err != nil {
-		fmt.Println(err)
-	}
+	return uem.actmap.OnTopic(m)
+}
+
+// OnParked sets a callback for the parked messages, once they are applied or failed
+func (uem *UyuniEventMapper) OnParked(callback ParkedCallback) {
+	uem.actmap.queue.SetParkedCallback(callback)
 }
 
 // OnIntReceive converts a sendable to everyone mesage about what just happened at Uyuni Server
@@ -77,9 +78,9 @@ func (uem *UyuniEventMapper) OnIntReceive(m *ncdtransport.InternalEventMessage)
 
 	payload, err := uem.intmap.OnTopic(m)
 	if err != nil {
-		fmt.Println("No actions defined on table", m.Topic)
+		fmt.Println("Event on table", m.Topic, "of", m.Source, "is not sent:", err.Error())
 	} else {
-		msg.Topic = path.Join(uem.TopicRoot(), m.Topic)
+		msg.Topic = path.Join(uem.TopicRoot(), uem.intmap.Topic(m))
 		msg.Payload = payload
 	}
 
@@ -89,100 +90,70 @@ func (uem *UyuniEventMapper) OnIntReceive(m *ncdtransport.InternalEventMessage)
 // Set XML-RPC user
 func (uem *UyuniEventMapper) SetRPCUser(user string) *UyuniEventMapper {
 	uem._user = user
+	uem._api.SetUser(uem._user, uem._pwd)
 	return uem
 }
 
 // Set XML-RPC password
 func (uem *UyuniEventMapper) SetRPCPassword(pwd string) *UyuniEventMapper {
 	uem._pwd = pwd
+	uem._api.SetUser(uem._user, uem._pwd)
 	return uem
 }
 
 // SetRPCUrl set URL for the connection point
 func (uem *UyuniEventMapper) SetRPCUrl(url string) *UyuniEventMapper {
-	uem._url = url
+	uem._api.SetURL(url)
 	return uem
 }
 
 // SetTLSVerify is to verify certs on SSL/TLS connections
 func (uem *UyuniEventMapper) SetTLSVerify(verify bool) *UyuniEventMapper {
-	uem._tls = verify
+	uem._api.SetTLSVerify(verify)
 	return uem
 }
 
-// This makes all the required indexes of common Uyuni Server data
-func (uem *UyuniEventMapper) IndexCommonData() {
-	definitions := map[string]string{
-		"channel": "channel.listAllChannels",
-	}
-	for topic, rpcf := range definitions {
-		fmt.Println("Indexing", topic, "...")
-		uem.index[topic] = uem.scall(rpcf)
-	}
+// SetRPCTimeout sets the timeout of each XML-RPC call
+func (uem *UyuniEventMapper) SetRPCTimeout(timeout time.Duration) *UyuniEventMapper {
+	uem._api.SetTimeout(timeout)
+	return uem
 }
 
-// Authenticate to Uyuni server
-func (uem *UyuniEventMapper) auth() {
-	var err error
-	var res interface{}
-	if uem._user != "" {
-		res, err = uem.call("auth.login", uem._user, uem._pwd)
-		if err != nil {
-			log.Fatal("Login error:", err.Error())
-		}
-		uem._session = res.(string)
-		log.Println("AUTH: Session:", uem._session)
-	} else {
-		log.Fatalf("User needs to be defined for XML-RPC login")
+// This makes all the required indexes of common Uyuni Server data
+func (uem *UyuniEventMapper) IndexCommonData() error {
+	fmt.Println("Indexing channel ...")
+	channels, err := uem.GetAPI().ListAllChannels(context.Background())
+	if err != nil {
+		return err
 	}
+	uem.index["channel"] = channels
+	return nil
 }
 
-// Internall sessioned call for the XML-RPC
-func (uem *UyuniEventMapper) scall(function string, args ...interface{}) interface{} {
-	var res interface{}
-
-	if uem._session == "" {
-		log.Println("SCALL has no session:", uem._session)
-		uem.auth()
+// Lookup an entity on the Uyuni Server by its key, e.g. "channel:<label>".
+// Entity, which cannot be looked up due to an error, is considered missing.
+func (uem *UyuniEventMapper) entityExists(key string) bool {
+	sep := strings.Index(key, ":")
+	if sep < 0 {
+		return false
 	}
+	kind, id := key[:sep], key[sep+1:]
 
-	_args := []interface{}{uem._session}
-	_args = append(_args, args...)
-
-	res, err := uem.call(function, _args...)
-	recall := err != nil
-	if err != nil {
-		log.Println(err.Error())
+	ctx := context.Background()
+	var err error
+	switch kind {
+	case "channel":
+		_, err = uem.GetAPI().GetChannelDetails(ctx, id)
+	default:
+		return false
 	}
-	if recall {
-		res, err = uem.call(function, _args...)
-		if err != nil {
-			log.Fatalln("XML-RPC crash:", err.Error())
-		}
+	if err != nil && !uyuni.IsNotFound(err) {
+		log.Printf("Cannot look up %s: %s", key, err.Error())
 	}
-
-	return res
-}
-
-// Internall direct call for the XML-RPC (raw)
-func (uem *UyuniEventMapper) call(function string, args ...interface{}) (interface{}, error) {
-	var res interface{}
-	return res, uem.GetRpc().Call(function, args, &res)
+	return err == nil
 }
 
-// Get XML-RPC client connection
-func (uem *UyuniEventMapper) GetRpc() *xmlrpc.Client {
-	if uem._rpc == nil {
-		if uem._url == "" {
-			panic("XML-RPC client needs an URL to connect")
-		}
-		var err error
-		uem._rpc, err = xmlrpc.NewClient(uem._url, &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: uem._tls},
-		})
-		if err != nil {
-			log.Fatalf("Unable to connect to %s: %s", uem._url, err.Error())
-		}
-	}
-	return uem._rpc
+// GetAPI returns Uyuni Server API client
+func (uem *UyuniEventMapper) GetAPI() *uyuni.Client {
+	return uem._api
 }
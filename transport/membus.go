@@ -0,0 +1,314 @@
+/*
+In-process message bus.
+
+MemBus implements the Bus without any server: all the buses, attached to the
+same MemBroker, see each other. It is used to run several ncd instances in one
+test binary, or a single-node deployment without NATS.
+
+Messages are delivered asynchronously, but in order per subscription, just like NATS does.
+If the inbox of a subscription is full, the message is dropped for it, as NATS does
+with a slow consumer, so a stuck handler does not block the publishers.
+*/
+
+package ncdtransport
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMemBroker is shared by all MemBus instances, created without own broker
+var DefaultMemBroker = NewMemBroker()
+
+type memSubscription struct {
+	broker   *MemBroker
+	subject  []string
+	queue    string
+	handler  BusHandler
+	inbox    chan *BusMsg
+	done     chan struct{}
+	draining chan struct{}
+	stopped  chan struct{} // Closed, when the delivery is finished
+	once     sync.Once
+	drained  sync.Once
+}
+
+// Unsubscribe the subscription. Messages, already queued for it, are dropped.
+func (ms *memSubscription) Unsubscribe() error {
+	ms.broker.remove(ms)
+	ms.once.Do(func() { close(ms.done) })
+	return nil
+}
+
+// Deliver queued messages to the handler in order. When draining, deliver the rest and stop.
+func (ms *memSubscription) run() {
+	defer close(ms.stopped)
+	for {
+		select {
+		case m := <-ms.inbox:
+			ms.handler(m)
+		case <-ms.done:
+			return
+		case <-ms.draining:
+			for {
+				select {
+				case m := <-ms.inbox:
+					ms.handler(m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Process all pending messages and unsubscribe. Waits until the handler is done with them,
+// so it must not be called from the handler of the same subscription.
+func (ms *memSubscription) drain() {
+	ms.broker.remove(ms)
+	ms.drained.Do(func() { close(ms.draining) })
+	<-ms.stopped
+	ms.once.Do(func() { close(ms.done) })
+}
+
+// Match subject tokens against subscription pattern with "*" and ">" wildcards
+func (ms *memSubscription) matches(subject []string) bool {
+	for idx, token := range ms.subject {
+		if token == ">" {
+			return len(subject) > idx
+		}
+		if idx >= len(subject) || (token != "*" && token != subject[idx]) {
+			return false
+		}
+	}
+	return len(subject) == len(ms.subject)
+}
+
+// MemBroker routes messages between MemBus instances
+type MemBroker struct {
+	subs   []*memSubscription
+	buffer int
+	mtx    sync.RWMutex
+}
+
+func NewMemBroker() *MemBroker {
+	mb := new(MemBroker)
+	mb.subs = make([]*memSubscription, 0)
+	mb.buffer = 10000
+	return mb
+}
+
+// SetBuffer sets how many messages are queued per subscription, before the next are dropped.
+// Applies to the new subscriptions. Default is 10000.
+func (mb *MemBroker) SetBuffer(size int) *MemBroker {
+	if size > 0 {
+		mb.mtx.Lock()
+		mb.buffer = size
+		mb.mtx.Unlock()
+	}
+	return mb
+}
+
+func (mb *MemBroker) bufferSize() int {
+	mb.mtx.RLock()
+	defer mb.mtx.RUnlock()
+	return mb.buffer
+}
+
+func (mb *MemBroker) add(sub *memSubscription) {
+	mb.mtx.Lock()
+	mb.subs = append(mb.subs, sub)
+	mb.mtx.Unlock()
+	go sub.run()
+}
+
+func (mb *MemBroker) remove(sub *memSubscription) {
+	mb.mtx.Lock()
+	defer mb.mtx.Unlock()
+	for idx, s := range mb.subs {
+		if s == sub {
+			mb.subs = append(mb.subs[:idx], mb.subs[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Route the message to all matching subscriptions and one member of each matching queue group
+func (mb *MemBroker) route(m *BusMsg) {
+	tokens := strings.Split(m.Subject, ".")
+	targets := make([]*memSubscription, 0)
+	queues := make(map[string][]*memSubscription)
+
+	mb.mtx.RLock()
+	for _, sub := range mb.subs {
+		if !sub.matches(tokens) {
+			continue
+		}
+		if sub.queue == "" {
+			targets = append(targets, sub)
+		} else {
+			queues[sub.queue] = append(queues[sub.queue], sub)
+		}
+	}
+	mb.mtx.RUnlock()
+
+	for _, members := range queues {
+		targets = append(targets, members[rand.Intn(len(members))])
+	}
+	for _, sub := range targets {
+		select {
+		case sub.inbox <- m:
+		case <-sub.done:
+		default:
+			log.Printf("Bus inbox of %s is full, message on %s is dropped", strings.Join(sub.subject, "."), m.Subject)
+		}
+	}
+}
+
+type MemBus struct {
+	broker    *MemBroker
+	state     BusState
+	subs      []*memSubscription
+	callbacks []BusStateCallback
+	mtx       sync.Mutex
+}
+
+func NewMemBus(broker *MemBroker) *MemBus {
+	bus := new(MemBus)
+	if broker == nil {
+		broker = DefaultMemBroker
+	}
+	bus.broker = broker
+	bus.state = BUS_DISCONNECTED
+	bus.subs = make([]*memSubscription, 0)
+	bus.callbacks = make([]BusStateCallback, 0)
+	return bus
+}
+
+// AddStateCallback adds a callback on the bus state change
+func (bus *MemBus) AddStateCallback(callback BusStateCallback) *MemBus {
+	bus.callbacks = append(bus.callbacks, callback)
+	return bus
+}
+
+func (bus *MemBus) setState(state BusState) {
+	bus.mtx.Lock()
+	bus.state = state
+	bus.mtx.Unlock()
+	for _, callback := range bus.callbacks {
+		callback(state)
+	}
+}
+
+// Start attaches the bus to the broker
+func (bus *MemBus) Start() error {
+	bus.setState(BUS_CONNECTED)
+	return nil
+}
+
+// State of the bus
+func (bus *MemBus) State() BusState {
+	bus.mtx.Lock()
+	defer bus.mtx.Unlock()
+	return bus.state
+}
+
+// Check that the bus can be used
+func (bus *MemBus) ready() error {
+	if bus.State() != BUS_CONNECTED {
+		return errors.New("bus is " + bus.State().String())
+	}
+	return nil
+}
+
+// Publish data to the subject
+func (bus *MemBus) Publish(subject string, data []byte) error {
+	return bus.publish(&BusMsg{Subject: subject, Data: data})
+}
+
+func (bus *MemBus) publish(m *BusMsg) error {
+	if err := bus.ready(); err != nil {
+		return err
+	}
+	bus.broker.route(m)
+	return nil
+}
+
+// Subscribe to the subject
+func (bus *MemBus) Subscribe(subject string, handler BusHandler) (BusSubscription, error) {
+	return bus.QueueSubscribe(subject, "", handler)
+}
+
+// QueueSubscribe subscribes to the subject in a queue group
+func (bus *MemBus) QueueSubscribe(subject string, queue string, handler BusHandler) (BusSubscription, error) {
+	if err := bus.ready(); err != nil {
+		return nil, err
+	}
+	sub := &memSubscription{
+		broker:   bus.broker,
+		subject:  strings.Split(subject, "."),
+		queue:    queue,
+		handler:  handler,
+		inbox:    make(chan *BusMsg, bus.broker.bufferSize()),
+		done:     make(chan struct{}),
+		draining: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	bus.broker.add(sub)
+
+	bus.mtx.Lock()
+	bus.subs = append(bus.subs, sub)
+	bus.mtx.Unlock()
+
+	return sub, nil
+}
+
+// Request publishes data and waits for a single reply
+func (bus *MemBus) Request(subject string, data []byte, timeout time.Duration) (*BusMsg, error) {
+	reply := make(chan *BusMsg, 1)
+	inbox := "_INBOX." + strings.Replace(uuid.New().String(), "-", "", -1)
+	sub, err := bus.Subscribe(inbox, func(m *BusMsg) {
+		select {
+		case reply <- m:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if err := bus.publish(&BusMsg{Subject: subject, Reply: inbox, Data: data}); err != nil {
+		return nil, err
+	}
+	select {
+	case m := <-reply:
+		return m, nil
+	case <-time.After(timeout):
+		return nil, errors.New("request timeout")
+	}
+}
+
+// Drain processes pending messages and unsubscribes everything
+func (bus *MemBus) Drain() error {
+	bus.mtx.Lock()
+	subs := bus.subs
+	bus.subs = make([]*memSubscription, 0)
+	bus.mtx.Unlock()
+
+	for _, sub := range subs {
+		sub.drain()
+	}
+	return nil
+}
+
+// Disconnect detaches the bus from the broker
+func (bus *MemBus) Disconnect() {
+	bus.Drain()
+	bus.setState(BUS_CLOSED)
+}
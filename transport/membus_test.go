@@ -0,0 +1,38 @@
+package ncdtransport
+
+import (
+	"testing"
+)
+
+func TestMemBusFullInboxDrops(t *testing.T) {
+	broker := NewMemBroker().SetBuffer(1)
+	bus := NewMemBus(broker)
+	if err := bus.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Disconnect()
+
+	release := make(chan struct{})
+	received := make(chan *BusMsg, 10)
+	if _, err := bus.Subscribe("test.stuck", func(m *BusMsg) {
+		<-release
+		received <- m
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Publisher is not blocked by the stuck handler
+	for idx := 0; idx < 5; idx++ {
+		if err := bus.Publish("test.stuck", []byte{byte(idx)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(release)
+	if err := bus.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) == 0 || len(received) >= 5 {
+		t.Fatalf("received %d of 5 messages, expected some to be dropped", len(received))
+	}
+}
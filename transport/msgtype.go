@@ -2,11 +2,42 @@ package ncdtransport
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Schema version of the MqMessage envelope. Increase it on every envelope change.
+// Messages of any version are accepted as long as they are well-formed: unknown
+// fields are ignored and missing ones are left empty, so different ncd versions
+// can run in one cluster during a rolling upgrade.
+//
+// Nodes before version 1 had no envelope version and panic on any unknown field,
+// while signatures, sequences and transactions need the headers. Upgrade from them
+// must be done on all the nodes at once.
+const MQ_SCHEMA_VERSION = 1
+
+// Registry of the typed payloads by topic
+var payloadTypes = make(map[string]reflect.Type)
+var payloadTypesMtx sync.RWMutex
+
+// RegisterPayloadType registers a type to decode the payload of a given topic.
+// Sample is any value of that type, e.g. RegisterPayloadType("/uyuni/rhnchannel", uyuni.Channel{}).
+func RegisterPayloadType(topic string, sample interface{}) {
+	payloadTypesMtx.Lock()
+	defer payloadTypesMtx.Unlock()
+	rtype := reflect.TypeOf(sample)
+	if rtype.Kind() == reflect.Ptr {
+		rtype = rtype.Elem()
+	}
+	payloadTypes[topic] = rtype
+}
+
 /*
 MqMessage can drive various topics.
 
@@ -22,40 +53,114 @@ that the "Payload" is a configuration management nanostate and should
 be passed down to the nanostate interpreter for further processing.
 */
 type MqMessage struct {
-	Id      string
-	Action  string
-	Topic   string
-	Payload interface{}
+	Version   int
+	Id        string
+	Timestamp time.Time
+	Headers   map[string]string `json:",omitempty"`
+	Action    string
+	Topic     string
+	Payload   interface{}
+	raw       json.RawMessage
+}
+
+// Wire form of the MqMessage to keep the payload raw until its type is known
+type mqEnvelope struct {
+	Version   int
+	Id        string
+	Timestamp time.Time
+	Headers   map[string]string
+	Action    string
+	Topic     string
+	Payload   json.RawMessage
 }
 
 func NewMqMessage() *MqMessage {
 	msg := new(MqMessage)
+	msg.Version = MQ_SCHEMA_VERSION
 	msg.Id = uuid.New().String()
+	msg.Timestamp = time.Now().UTC()
+	msg.Headers = make(map[string]string)
 
 	return msg
 }
 
-// Load self content from given bytes
-func (bm *MqMessage) FromBytes(data []byte) *MqMessage {
-	var content map[string]interface{}
-	if err := json.Unmarshal(data, &content); err != nil {
-		log.Panicln("Error loading incoming JSON:", err.Error())
+// SetHeader sets a header value
+func (bm *MqMessage) SetHeader(name string, value string) *MqMessage {
+	if bm.Headers == nil {
+		bm.Headers = make(map[string]string)
 	}
-	for section, obj := range content {
-		switch section {
-		case "Topic":
-			bm.Topic = obj.(string)
-		case "Payload":
-			bm.Payload = obj
-		case "Id":
-			bm.Id = obj.(string)
-		case "Action":
-			bm.Action = obj.(string)
-		default:
-			log.Panicln("Unknown type section:", section)
+	bm.Headers[name] = value
+	return bm
+}
+
+// GetHeader returns a header value or an empty string
+func (bm *MqMessage) GetHeader(name string) string {
+	return bm.Headers[name]
+}
+
+// Load self content from given bytes. Unknown fields are ignored,
+// malformed messages are rejected with an error.
+func (bm *MqMessage) FromBytes(data []byte) (*MqMessage, error) {
+	env := new(mqEnvelope)
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, fmt.Errorf("malformed message: %s", err.Error())
+	}
+	if env.Id == "" {
+		return nil, errors.New("malformed message: no Id")
+	}
+	if env.Topic == "" {
+		return nil, fmt.Errorf("malformed message %s: no Topic", env.Id)
+	}
+	if env.Version > MQ_SCHEMA_VERSION {
+		log.Printf("Message %s has newer schema version %d, decoding known fields only", env.Id, env.Version)
+	}
+
+	bm.Version = env.Version
+	bm.Id = env.Id
+	bm.Timestamp = env.Timestamp
+	bm.Headers = env.Headers
+	if bm.Headers == nil {
+		bm.Headers = make(map[string]string)
+	}
+	bm.Action = env.Action
+	bm.Topic = env.Topic
+	bm.raw = env.Payload
+	bm.Payload = nil
+	if len(env.Payload) > 0 {
+		if err := json.Unmarshal(env.Payload, &bm.Payload); err != nil {
+			return nil, fmt.Errorf("malformed message %s payload: %s", env.Id, err.Error())
 		}
 	}
-	return bm
+
+	return bm, nil
+}
+
+// DecodePayload decodes the payload into the type, registered for the message topic.
+// Returns a pointer to a new value of that type.
+func (bm *MqMessage) DecodePayload() (interface{}, error) {
+	payloadTypesMtx.RLock()
+	rtype, ex := payloadTypes[bm.Topic]
+	payloadTypesMtx.RUnlock()
+	if !ex {
+		return nil, fmt.Errorf("no payload type registered for topic '%s'", bm.Topic)
+	}
+	obj := reflect.New(rtype).Interface()
+	return obj, bm.PayloadInto(obj)
+}
+
+// PayloadInto decodes the payload into a given object
+func (bm *MqMessage) PayloadInto(obj interface{}) error {
+	raw := bm.raw
+	if raw == nil {
+		var err error
+		if raw, err = json.Marshal(bm.Payload); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return fmt.Errorf("payload of message %s on topic '%s' does not match %T: %s", bm.Id, bm.Topic, obj, err.Error())
+	}
+	return nil
 }
 
 // Serialise this object to bytes
@@ -76,38 +181,55 @@ type InternalEventMessage struct {
 	Payload map[string]interface{}
 	Topic   string
 	Action  string
+	Source  string // Name of the database source
+	Channel string // Notification channel, if any
 }
 
 func NewInternalEventMessage(data map[string]interface{}) *InternalEventMessage {
 	dem := new(InternalEventMessage)
-	dem.Topic = data["table"].(string)
-	dem.Action = strings.ToLower(data["action"].(string))
-	dem.Payload = data["data"].(map[string]interface{})
+	dem.Topic, _ = data["table"].(string)
+	action, _ := data["action"].(string)
+	dem.Action = strings.ToLower(action)
+	if dem.Payload, _ = data["data"].(map[string]interface{}); dem.Payload == nil {
+		dem.Payload = make(map[string]interface{})
+	}
+	dem.Source, _ = data["source"].(string)
+	dem.Channel, _ = data["channel"].(string)
 
 	return dem
 }
 
+// FromData loads self content from the map. Unknown sections and values of unexpected types are skipped.
 func (iem *InternalEventMessage) FromData(data map[string]interface{}) *InternalEventMessage {
 	for section, obj := range data {
+		var ok bool
 		switch section {
 		case "Topic":
-			iem.Topic = obj.(string)
+			iem.Topic, ok = obj.(string)
 		case "Payload":
-			iem.Payload = obj.(map[string]interface{})
+			var payload map[string]interface{}
+			if payload, ok = obj.(map[string]interface{}); ok {
+				iem.Payload = payload
+			}
 		case "Action":
-			iem.Action = obj.(string)
-		default:
-			log.Panicln("Unknown type section:", section)
+			iem.Action, ok = obj.(string)
+		case "Source":
+			iem.Source, ok = obj.(string)
+		case "Channel":
+			iem.Channel, ok = obj.(string)
+		}
+		if !ok {
+			log.Println("Skipping unknown or malformed event section:", section)
 		}
 	}
 	return iem
 }
 
 // Load self content from given bytes
-func (iem *InternalEventMessage) FromBytes(data []byte) *InternalEventMessage {
+func (iem *InternalEventMessage) FromBytes(data []byte) (*InternalEventMessage, error) {
 	var content map[string]interface{}
 	if err := json.Unmarshal(data, &content); err != nil {
-		log.Panicln("Error loading incoming JSON:", err.Error())
+		return nil, fmt.Errorf("malformed event: %s", err.Error())
 	}
-	return iem.FromData(content)
+	return iem.FromData(content), nil
 }
@@ -0,0 +1,203 @@
+/*
+Embedded NATS server.
+
+For small or test clusters ncd can run the NATS server in its own process
+instead of connecting to a separate service. Embedded servers of several
+ncd nodes form a cluster through routes: each node listens for routes on
+its cluster port and connects to the cluster ports of the other nodes.
+
+Routes are not encrypted, so embedded cluster is meant for trusted networks.
+Cluster port listens on the loopback by default. Listening on other addresses
+requires route credentials, which all the servers of the cluster share.
+*/
+
+package ncdtransport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats-server/v2/server"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type EmbeddedNatsServer struct {
+	host    string
+	port    int
+	chost   string
+	cport   int
+	routes  []string
+	ruser   string
+	rpass   string
+	verbose bool
+	timeout time.Duration
+	srv     *server.Server
+}
+
+func NewEmbeddedNatsServer() *EmbeddedNatsServer {
+	ens := new(EmbeddedNatsServer)
+	ens.host = "127.0.0.1"
+	ens.port = 4222
+	ens.chost = "127.0.0.1"
+	ens.routes = make([]string, 0)
+	ens.timeout = 10 * time.Second
+	return ens
+}
+
+// SetListen sets the address for the clients. Default is 127.0.0.1:4222.
+func (ens *EmbeddedNatsServer) SetListen(host string, port int) *EmbeddedNatsServer {
+	if host != "" {
+		ens.host = host
+	}
+	if port != 0 {
+		ens.port = port
+	}
+	return ens
+}
+
+// SetCluster sets the address for the routes of the other servers. Default host is 127.0.0.1,
+// port 0 disables clustering.
+func (ens *EmbeddedNatsServer) SetCluster(host string, port int) *EmbeddedNatsServer {
+	if host != "" {
+		ens.chost = host
+	}
+	ens.cport = port
+	return ens
+}
+
+// SetRouteAuth sets the credentials, which the routes of the cluster authenticate with
+func (ens *EmbeddedNatsServer) SetRouteAuth(user string, password string) *EmbeddedNatsServer {
+	ens.ruser = user
+	ens.rpass = password
+	return ens
+}
+
+// AddRoutes adds comma-separated "host:port" list of the cluster ports of the other servers
+func (ens *EmbeddedNatsServer) AddRoutes(routes string) *EmbeddedNatsServer {
+	for _, route := range strings.Split(routes, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			if !strings.Contains(route, "://") {
+				route = "nats-route://" + route
+			}
+			ens.routes = append(ens.routes, route)
+		}
+	}
+	return ens
+}
+
+// SetVerbose turns on the server log
+func (ens *EmbeddedNatsServer) SetVerbose(verbose bool) *EmbeddedNatsServer {
+	ens.verbose = verbose
+	return ens
+}
+
+// SetStartTimeout sets how long to wait for the server to accept connections
+func (ens *EmbeddedNatsServer) SetStartTimeout(timeout time.Duration) *EmbeddedNatsServer {
+	ens.timeout = timeout
+	return ens
+}
+
+// Start the server and wait until it accepts connections
+func (ens *EmbeddedNatsServer) Start() error {
+	if ens.srv != nil {
+		return nil
+	}
+	if len(ens.routes) > 0 && ens.cport == 0 {
+		return errors.New("embedded bus server has routes, but no cluster port")
+	}
+	if ens.cport != 0 && ens.ruser == "" && !isLoopback(ens.chost) {
+		return fmt.Errorf("embedded bus cluster listens on %s without route credentials", ens.chost)
+	}
+
+	opts := &server.Options{
+		Host:   ens.host,
+		Port:   ens.port,
+		NoSigs: true,
+		NoLog:  !ens.verbose,
+	}
+	if ens.cport != 0 {
+		opts.Cluster.Host = ens.chost
+		opts.Cluster.Port = ens.cport
+		opts.Cluster.Username = ens.ruser
+		opts.Cluster.Password = ens.rpass
+		routes, err := ens.routeURLs()
+		if err != nil {
+			return err
+		}
+		opts.Routes = routes
+	}
+
+	srv, err := server.NewServer(opts)
+	if err != nil {
+		return fmt.Errorf("cannot setup embedded bus server: %s", err.Error())
+	}
+	if ens.verbose {
+		srv.ConfigureLogger()
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(ens.timeout) {
+		srv.Shutdown()
+		return fmt.Errorf("embedded bus server is not ready within %s", ens.timeout)
+	}
+	ens.srv = srv
+
+	if ens.cport != 0 {
+		log.Printf("Embedded bus server is running on %s, cluster on %s:%d, routes: %s",
+			srv.Addr(), ens.chost, ens.cport, strings.Join(ens.routes, ", "))
+	} else {
+		log.Printf("Embedded bus server is running on %s", srv.Addr())
+	}
+	return nil
+}
+
+// Route URLs with the route credentials
+func (ens *EmbeddedNatsServer) routeURLs() ([]*url.URL, error) {
+	routes := make([]*url.URL, 0, len(ens.routes))
+	for _, route := range ens.routes {
+		rurl, err := url.Parse(route)
+		if err != nil {
+			return nil, fmt.Errorf("wrong route '%s': %s", route, err.Error())
+		}
+		if rurl.User == nil && ens.ruser != "" {
+			rurl.User = url.UserPassword(ens.ruser, ens.rpass)
+		}
+		routes = append(routes, rurl)
+	}
+	return routes, nil
+}
+
+// Returns true, if the host is a loopback address
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Address, where the local clients connect to the running server
+func (ens *EmbeddedNatsServer) clientAddr() (string, int, error) {
+	if ens.srv == nil {
+		return "", 0, errors.New("embedded bus server is not running")
+	}
+	addr, ok := ens.srv.Addr().(*net.TCPAddr)
+	if !ok {
+		return "", 0, errors.New("embedded bus server has no TCP address")
+	}
+	host := ens.host
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return host, addr.Port, nil
+}
+
+// Shutdown the server
+func (ens *EmbeddedNatsServer) Shutdown() {
+	if ens.srv != nil {
+		ens.srv.Shutdown()
+		ens.srv = nil
+	}
+}
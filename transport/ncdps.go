@@ -5,93 +5,597 @@
 package ncdtransport
 
 import (
+	"errors"
 	"fmt"
 	"github.com/nats-io/nats.go"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// BusState is a state of the bus connection
+type BusState int
+
+const (
+	BUS_DISCONNECTED BusState = iota
+	BUS_CONNECTING
+	BUS_CONNECTED
+	BUS_RECONNECTING
+	BUS_CLOSED
+)
+
+func (bs BusState) String() string {
+	return [...]string{"disconnected", "connecting", "connected", "reconnecting", "closed"}[bs]
+}
+
+// BusStateCallback is called on every change of the bus connection state
+type BusStateCallback func(state BusState)
+
+// Message, published while the bus was not available
+type pendingMsg struct {
+	subject string
+	data    []byte
+}
+
 type NatsURL struct {
 	Scheme string
 	Fqdn   string
 	Port   int
 }
 
+// NatsAuth holds TLS and authentication setup of the bus connection
+type NatsAuth struct {
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+	User      string
+	Password  string
+	Token     string
+	NKeySeed  string // Path to the NKey seed file
+	CredsFile string // Path to the .creds file (JWT and NKey seed)
+	Insecure  bool   // Allow plain text connections with credentials or to remote hosts
+}
+
 type NcdPubSub struct {
-	urls []*NatsURL
-	ncp  *nats.Conn
-	ncs  *nats.Conn
+	urls      []*NatsURL
+	auth      *NatsAuth
+	embedded  *EmbeddedNatsServer
+	ncp       *nats.Conn
+	ncs       *nats.Conn
+	state     BusState
+	callbacks []BusStateCallback
+	pending   []*pendingMsg
+	maxbuff   int
+	wait      time.Duration
+	maxwait   time.Duration
+	mtx       sync.Mutex
 }
 
 func NewNcdPubSub() *NcdPubSub {
 	ncd := new(NcdPubSub)
 	ncd.urls = make([]*NatsURL, 0)
+	ncd.auth = &NatsAuth{}
+	ncd.state = BUS_DISCONNECTED
+	ncd.callbacks = make([]BusStateCallback, 0)
+	ncd.pending = make([]*pendingMsg, 0)
+	ncd.maxbuff = 10000
+	ncd.wait = time.Second
+	ncd.maxwait = time.Minute
 	return ncd
 }
 
+// AddNatsServerURLs adds comma-separated "[scheme://]host[:port]" list of NATS servers.
+// Scheme is "nats" (default) or "tls". Default port is 4222.
+func (ncd *NcdPubSub) AddNatsServerURLs(servers string) *NcdPubSub {
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		scheme := "nats"
+		if idx := strings.Index(server, "://"); idx > -1 {
+			if scheme = strings.ToLower(server[:idx]); scheme != "nats" && scheme != "tls" {
+				log.Printf("Unsupported scheme in bus URL '%s', skipping", server)
+				continue
+			}
+			server = server[idx+3:]
+		}
+		port := 4222
+		if host, sport, err := net.SplitHostPort(server); err == nil {
+			if port, err = strconv.Atoi(sport); err != nil {
+				log.Printf("Wrong port in bus URL '%s', skipping", server)
+				continue
+			}
+			server = host
+		}
+		ncd.urls = append(ncd.urls, &NatsURL{Scheme: scheme, Fqdn: server, Port: port})
+	}
+	return ncd
+}
+
+// SetReconnectWait sets initial and maximal waiting time between reconnection attempts.
+// The wait is doubled after each attempt on all the servers, up to the maximum.
+func (ncd *NcdPubSub) SetReconnectWait(wait time.Duration, maxwait time.Duration) *NcdPubSub {
+	ncd.wait = wait
+	ncd.maxwait = maxwait
+	return ncd
+}
+
+// SetBufferSize sets how many messages are buffered, while the bus is not available.
+// Oldest messages are discarded on overflow.
+func (ncd *NcdPubSub) SetBufferSize(size int) *NcdPubSub {
+	ncd.maxbuff = size
+	return ncd
+}
+
+// AddStateCallback adds a callback on the bus connection state change
+func (ncd *NcdPubSub) AddStateCallback(callback BusStateCallback) *NcdPubSub {
+	ncd.callbacks = append(ncd.callbacks, callback)
+	return ncd
+}
+
+// State returns current state of the bus connection
+func (ncd *NcdPubSub) State() BusState {
+	ncd.mtx.Lock()
+	defer ncd.mtx.Unlock()
+	return ncd.state
+}
+
+// Buffered returns the amount of messages, waiting for the bus to be available
+func (ncd *NcdPubSub) Buffered() int {
+	ncd.mtx.Lock()
+	defer ncd.mtx.Unlock()
+	return len(ncd.pending)
+}
+
 // AddNatsServerURL adds NATS server URL to the cluster of servers to connect
 func (ncd *NcdPubSub) AddNatsServerURL(host string, port int) *NcdPubSub {
 	ncd.urls = append(ncd.urls, &NatsURL{Scheme: "nats", Fqdn: host, Port: port})
 	return ncd
 }
 
-// IsConnected currently only indicates if the connection is initialised
+// SetEmbeddedServer runs the NATS server within ncd. Then the bus connects only to it,
+// and the other servers are reached through its cluster routes.
+func (ncd *NcdPubSub) SetEmbeddedServer(embedded *EmbeddedNatsServer) *NcdPubSub {
+	ncd.embedded = embedded
+	return ncd
+}
+
+// GetEmbeddedServer returns the embedded NATS server or nil
+func (ncd *NcdPubSub) GetEmbeddedServer() *EmbeddedNatsServer {
+	return ncd.embedded
+}
+
+// SetTLS enables TLS with a CA certificate to verify the server.
+// Client certificate and key are optional and used for mutual TLS.
+func (ncd *NcdPubSub) SetTLS(ca string, cert string, key string) *NcdPubSub {
+	ncd.auth.CAFile = ca
+	ncd.auth.CertFile = cert
+	ncd.auth.KeyFile = key
+	return ncd
+}
+
+// SetUserPassword sets user/password authentication
+func (ncd *NcdPubSub) SetUserPassword(user string, password string) *NcdPubSub {
+	ncd.auth.User = user
+	ncd.auth.Password = password
+	return ncd
+}
+
+// SetToken sets token authentication
+func (ncd *NcdPubSub) SetToken(token string) *NcdPubSub {
+	ncd.auth.Token = token
+	return ncd
+}
+
+// SetNKeySeed sets path to the NKey seed file for NKey authentication
+func (ncd *NcdPubSub) SetNKeySeed(seed string) *NcdPubSub {
+	ncd.auth.NKeySeed = seed
+	return ncd
+}
+
+// SetCredentialsFile sets path to the .creds file for JWT authentication
+func (ncd *NcdPubSub) SetCredentialsFile(creds string) *NcdPubSub {
+	ncd.auth.CredsFile = creds
+	return ncd
+}
+
+// SetInsecure allows sending credentials over plain text or connecting remote hosts without TLS.
+// Do not use it in production.
+func (ncd *NcdPubSub) SetInsecure(insecure bool) *NcdPubSub {
+	ncd.auth.Insecure = insecure
+	return ncd
+}
+
+// IsTLS returns true if the bus connection is TLS-secured: either CA or client certificate is set,
+// or any server URL has "tls" scheme, verified by the system roots.
+func (ncd *NcdPubSub) IsTLS() bool {
+	if ncd.embedded != nil {
+		return false // Embedded server is connected locally
+	}
+	if ncd.auth.CAFile != "" || ncd.auth.CertFile != "" {
+		return true
+	}
+	for _, nurl := range ncd.urls {
+		if nurl.Scheme == "tls" {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxPayload returns the maximal message size, announced by the server, or 0 if not connected
+func (ncd *NcdPubSub) MaxPayload() int {
+	ncp, _ := ncd.conns()
+	if ncp == nil {
+		return 0
+	}
+	return int(ncp.MaxPayload())
+}
+
+// IsConnected returns true if both publisher and subscriber connections are up
 func (ncd *NcdPubSub) IsConnected() bool {
-	return ncd.ncp != nil && ncd.ncs != nil
+	ncp, ncs := ncd.conns()
+	return ncp != nil && ncs != nil && ncp.IsConnected() && ncs.IsConnected()
+}
+
+// Get publisher and subscriber connections
+func (ncd *NcdPubSub) conns() (*nats.Conn, *nats.Conn) {
+	ncd.mtx.Lock()
+	defer ncd.mtx.Unlock()
+	return ncd.ncp, ncd.ncs
+}
+
+// Waiting time before the next round of reconnection attempts, starting from 1
+func (ncd *NcdPubSub) reconnectDelay(attempts int) time.Duration {
+	wait := ncd.wait
+	for ; attempts > 1 && wait < ncd.maxwait; attempts-- {
+		wait *= 2
+	}
+	if wait > ncd.maxwait {
+		wait = ncd.maxwait
+	}
+	// Jitter, so the nodes do not reconnect all at once
+	if wait >= 10*time.Millisecond {
+		wait += time.Duration(rand.Int63n(int64(wait / 10)))
+	}
+	return wait
+}
+
+// Publish data to the subject. While the bus is not available, data is buffered
+// and published once the connection is restored.
+func (ncd *NcdPubSub) Publish(subject string, data []byte) error {
+	ncd.mtx.Lock()
+	defer ncd.mtx.Unlock()
+
+	if ncd.state == BUS_CLOSED {
+		return errors.New("bus connection is closed")
+	}
+	if ncd.state == BUS_CONNECTED {
+		ncd.flush() // Buffered messages go first
+	}
+	if ncd.state != BUS_CONNECTED || len(ncd.pending) > 0 {
+		ncd.buffer(subject, data)
+		return nil
+	}
+	if err := ncd.ncp.Publish(subject, data); err != nil {
+		if isConnectionError(err) {
+			ncd.buffer(subject, data)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Returns true, if publishing failed only because the connection is not available at the moment
+func isConnectionError(err error) bool {
+	return err == nats.ErrConnectionClosed || err == nats.ErrConnectionReconnecting || err == nats.ErrDisconnected
+}
+
+// Buffer a message. Requires lock.
+func (ncd *NcdPubSub) buffer(subject string, data []byte) {
+	ncd.pending = append(ncd.pending, &pendingMsg{subject: subject, data: data})
+	if ncd.maxbuff > 0 && len(ncd.pending) > ncd.maxbuff {
+		ncd.pending = ncd.pending[1:]
+		log.Println("Bus buffer is full, oldest message has been discarded")
+	}
+}
+
+// Publish buffered messages. If the connection is lost meanwhile, the rest is kept
+// for the next publish or reconnect. Messages, which cannot be published at all, are discarded.
+// Requires lock.
+func (ncd *NcdPubSub) flush() {
+	if len(ncd.pending) > 0 {
+		log.Printf("Publishing %d buffered messages", len(ncd.pending))
+	}
+	for len(ncd.pending) > 0 && ncd.state == BUS_CONNECTED {
+		msg := ncd.pending[0]
+		if err := ncd.ncp.Publish(msg.subject, msg.data); err != nil {
+			if isConnectionError(err) {
+				log.Println("Unable to publish buffered messages:", err.Error())
+				return
+			}
+			log.Println("Buffered message to", msg.subject, "is discarded:", err.Error())
+		}
+		ncd.pending = ncd.pending[1:]
+	}
+}
+
+// Change connection state and notify the callbacks
+func (ncd *NcdPubSub) setState(state BusState) {
+	ncd.mtx.Lock()
+	if ncd.state == state || ncd.state == BUS_CLOSED {
+		ncd.mtx.Unlock()
+		return
+	}
+	ncd.state = state
+	if state == BUS_CONNECTED {
+		ncd.flush()
+	}
+	ncd.mtx.Unlock()
+
+	log.Println("Bus is", state.String())
+	for _, callback := range ncd.callbacks {
+		callback(state)
+	}
+}
+
+// Derive the state of the bus from both connections
+func (ncd *NcdPubSub) updateState(nc *nats.Conn) {
+	switch {
+	case nc.IsClosed():
+		ncd.setState(BUS_CLOSED)
+	case ncd.IsConnected():
+		ncd.setState(BUS_CONNECTED)
+	default:
+		ncd.setState(BUS_RECONNECTING)
+	}
 }
 
 // Format cluster URLs
 func (ncd *NcdPubSub) getClusterURLs() string {
 	buff := make([]string, 0)
 	for _, nurl := range ncd.urls {
-		buff = append(buff, fmt.Sprintf("%s://%s:%d", nurl.Scheme, nurl.Fqdn, nurl.Port))
+		scheme := nurl.Scheme
+		if ncd.IsTLS() && scheme == "nats" {
+			scheme = "tls"
+		}
+		buff = append(buff, fmt.Sprintf("%s://%s:%d", scheme, nurl.Fqdn, nurl.Port))
 	}
 	return strings.Join(buff, ", ")
 }
 
+// Check if all bus URLs are pointing to the local host
+func (ncd *NcdPubSub) isLocal() bool {
+	for _, nurl := range ncd.urls {
+		if nurl.Fqdn == "localhost" || nurl.Fqdn == "" {
+			continue
+		}
+		if ip := net.ParseIP(nurl.Fqdn); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate security setup and compile connection options
+func (ncd *NcdPubSub) options() ([]nats.Option, error) {
+	auth := ncd.auth
+	opts := make([]nats.Option, 0)
+	// Embedded server is connected locally, it has no TLS and authentication
+	if ncd.embedded != nil {
+		return opts, nil
+	}
+
+	methods := 0
+	for _, set := range []bool{auth.User != "", auth.Token != "", auth.NKeySeed != "", auth.CredsFile != ""} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return nil, errors.New("only one of user/password, token, NKey seed or credentials file can be used")
+	}
+
+	if ncd.IsTLS() {
+		if (auth.CertFile == "") != (auth.KeyFile == "") {
+			return nil, errors.New("TLS client certificate and key should be both specified")
+		}
+		if auth.CAFile != "" {
+			if _, err := ioutil.ReadFile(auth.CAFile); err != nil {
+				return nil, fmt.Errorf("TLS CA file: %s", err.Error())
+			}
+			opts = append(opts, nats.RootCAs(auth.CAFile))
+		}
+		if auth.CertFile != "" {
+			if err := checkSecretFile("TLS key", auth.KeyFile); err != nil {
+				return nil, err
+			}
+			opts = append(opts, nats.ClientCert(auth.CertFile, auth.KeyFile))
+		}
+		opts = append(opts, nats.Secure())
+	} else if !auth.Insecure {
+		if auth.User != "" || auth.Token != "" {
+			return nil, errors.New("password or token would be sent in plain text: setup TLS or explicitly allow insecure connection")
+		}
+		if !ncd.isLocal() {
+			return nil, errors.New("connection to a remote bus is not encrypted: setup TLS or explicitly allow insecure connection")
+		}
+	}
+
+	switch {
+	case auth.User != "":
+		if auth.Password == "" {
+			return nil, fmt.Errorf("password for the user '%s' is missing", auth.User)
+		}
+		opts = append(opts, nats.UserInfo(auth.User, auth.Password))
+	case auth.Token != "":
+		opts = append(opts, nats.Token(auth.Token))
+	case auth.NKeySeed != "":
+		if err := checkSecretFile("NKey seed", auth.NKeySeed); err != nil {
+			return nil, err
+		}
+		opt, err := nats.NkeyOptionFromSeed(auth.NKeySeed)
+		if err != nil {
+			return nil, fmt.Errorf("NKey seed: %s", err.Error())
+		}
+		opts = append(opts, opt)
+	case auth.CredsFile != "":
+		if err := checkSecretFile("Credentials", auth.CredsFile); err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.UserCredentials(auth.CredsFile))
+	}
+
+	return opts, nil
+}
+
+// Connect a single connection, retrying with backoff until it succeeds
+func (ncd *NcdPubSub) dial(label string, opts []nats.Option) *nats.Conn {
+	wait := ncd.wait
+	for {
+		nc, err := nats.Connect(ncd.getClusterURLs(), opts...)
+		if err == nil {
+			log.Print("Connected ", label)
+			return nc
+		}
+		log.Printf("Unable to connect %s: %s. Retrying in %s", label, err.Error(), wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > ncd.maxwait {
+			wait = ncd.maxwait
+		}
+	}
+}
+
 // Connect to the cluster
-func (ncd *NcdPubSub) connect() {
-	var err error
-	log.Printf("Connecting to %s...", ncd.getClusterURLs())
-	if !ncd.IsConnected() {
-		ncd.ncp, err = nats.Connect(ncd.getClusterURLs())
-		log.Print("Connected publisher")
+func (ncd *NcdPubSub) connect() error {
+	if ncd.embedded != nil {
+		if err := ncd.embedded.Start(); err != nil {
+			return err
+		}
+		host, port, err := ncd.embedded.clientAddr()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		ncd.ncs, err = nats.Connect(ncd.getClusterURLs())
-		log.Print("Connected subscriber")
+		ncd.urls = []*NatsURL{{Scheme: "nats", Fqdn: host, Port: port}}
+	}
+	if len(ncd.urls) == 0 {
+		return errors.New("no bus servers defined")
+	}
+	log.Printf("Connecting to %s...", ncd.getClusterURLs())
+	if !ncd.IsConnected() {
+		opts, err := ncd.options()
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("bus security setup error: %s", err.Error())
 		}
+		opts = append(opts,
+			nats.MaxReconnects(-1),
+			nats.CustomReconnectDelay(ncd.reconnectDelay),
+			nats.DisconnectHandler(ncd.updateState),
+			nats.ReconnectHandler(ncd.updateState),
+			nats.ClosedHandler(ncd.updateState))
+
+		ncd.setState(BUS_CONNECTING)
+		ncp := ncd.dial("publisher", opts)
+		ncs := ncd.dial("subscriber", opts)
+		ncd.mtx.Lock()
+		ncd.ncp, ncd.ncs = ncp, ncs
+		ncd.mtx.Unlock()
+		ncd.updateState(ncp)
 	}
+	return nil
 }
 
 // Disconnect from the cluster
 func (ncd *NcdPubSub) Disconnect() {
-	if ncd.IsConnected() {
+	if ncp, ncs := ncd.conns(); ncp != nil && ncs != nil {
 		log.Print("Begin disconnect")
-		for _, nc := range [2]*nats.Conn{ncd.ncp, ncd.ncs} {
+		for _, nc := range [2]*nats.Conn{ncp, ncs} {
 			if err := nc.Drain(); err != nil {
 				log.Println(err.Error())
 			}
 			nc.Close()
 		}
-		ncd.ncp = nil
-		ncd.ncs = nil
+		ncd.setState(BUS_CLOSED)
 		log.Print("Disconected")
 	}
+	if ncd.embedded != nil {
+		ncd.embedded.Shutdown()
+	}
+}
+
+// Wrap NATS handler
+func (ncd *NcdPubSub) natsHandler(handler BusHandler) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		handler(&BusMsg{Subject: m.Subject, Reply: m.Reply, Data: m.Data})
+	}
+}
+
+// Subscribe to the subject
+func (ncd *NcdPubSub) Subscribe(subject string, handler BusHandler) (BusSubscription, error) {
+	_, ncs := ncd.conns()
+	if ncs == nil {
+		return nil, errors.New("bus is not connected")
+	}
+	sub, err := ncs.Subscribe(subject, ncd.natsHandler(handler))
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// QueueSubscribe subscribes to the subject in a queue group
+func (ncd *NcdPubSub) QueueSubscribe(subject string, queue string, handler BusHandler) (BusSubscription, error) {
+	_, ncs := ncd.conns()
+	if ncs == nil {
+		return nil, errors.New("bus is not connected")
+	}
+	sub, err := ncs.QueueSubscribe(subject, queue, ncd.natsHandler(handler))
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Request publishes data and waits for a single reply
+func (ncd *NcdPubSub) Request(subject string, data []byte, timeout time.Duration) (*BusMsg, error) {
+	ncp, _ := ncd.conns()
+	if ncp == nil {
+		return nil, errors.New("bus is not connected")
+	}
+	m, err := ncp.Request(subject, data, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &BusMsg{Subject: m.Subject, Reply: m.Reply, Data: m.Data}, nil
+}
+
+// Drain processes pending messages and unsubscribes everything
+func (ncd *NcdPubSub) Drain() error {
+	_, ncs := ncd.conns()
+	if ncs == nil {
+		return nil
+	}
+	return ncs.Drain()
 }
 
 func (ncd *NcdPubSub) GetPublisher() *nats.Conn {
-	return ncd.ncp
+	ncp, _ := ncd.conns()
+	return ncp
 }
 func (ncd *NcdPubSub) GetSubscriber() *nats.Conn {
-	return ncd.ncs
+	_, ncs := ncd.conns()
+	return ncs
 }
 
 // Start starts the Node Controller
-func (ncd *NcdPubSub) Start() {
+func (ncd *NcdPubSub) Start() error {
 	log.Print("Starting ncd event listener...")
-	ncd.connect()
+	return ncd.connect()
 }
@@ -0,0 +1,561 @@
+/*
+Object transfer is used to move binary blobs (packages, large config files etc)
+between the nodes over the bus. A single MqMessage cannot carry them, so
+objects are cut into sequenced chunks, each of them checksummed, while the
+whole object is verified by SHA-256 once assembled on the receiving side.
+
+Protocol:
+
+ 1. Sender publishes an "offer" with the object metadata and starts
+    publishing chunks in sequence.
+ 2. Receiver writes every chunk at its offset into a spool file and keeps
+    a journal of received chunks, so the transfer survives restarts.
+ 3. If chunks are missing (lost or receiver restarted), receiver asks
+    the sender to resend only those, via sender's resend subject.
+ 4. Once all chunks are there, the object is verified and handed over.
+
+Every frame is signed by the sending node and verified by the MessageSigner,
+so objects are accepted only from the trusted nodes. Chunks are accepted only
+from the node, which has offered the object.
+*/
+
+package ncdtransport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OBJECT_CHUNK_SIZE = 256 * 1024
+
+	OBJ_OFFER  = "offer"
+	OBJ_CHUNK  = "chunk"
+	OBJ_RESEND = "resend"
+)
+
+// ObjectInfo describes an object being transferred
+type ObjectInfo struct {
+	Id        string
+	Name      string
+	Topic     string
+	Size      int64
+	Checksum  string
+	ChunkSize int
+	Total     int
+	Origin    string // Resend subject of the sender
+}
+
+// ObjectFrame is a single unit on the wire
+type ObjectFrame struct {
+	Kind      string
+	Info      *ObjectInfo `json:",omitempty"`
+	Id        string
+	Seq       int
+	Checksum  string
+	Data      []byte `json:",omitempty"`
+	Missing   []int  `json:",omitempty"`
+	Signer    string `json:",omitempty"`
+	Time      time.Time
+	Signature string `json:",omitempty"`
+}
+
+// ObjectCallback is called when the object is completely received and verified.
+// The "path" is the location of the object file on the local filesystem.
+type ObjectCallback func(info *ObjectInfo, path string)
+
+// Receiver journal of a partially transferred object
+type objectJournal struct {
+	Info     *ObjectInfo
+	Sender   string // Signer of the offer
+	Received map[int]bool
+	Updated  time.Time // Last activity, including resend requests
+	Progress time.Time // Last received chunk
+}
+
+// Sender registry entry of an offered object
+type objectOffer struct {
+	filename string
+	touched  time.Time
+}
+
+type ObjectTransfer struct {
+	bus       Bus
+	subject   string
+	origin    string
+	spool     string
+	chunksize int
+	timeout   time.Duration
+	expiry    time.Duration
+	offered   map[string]*objectOffer
+	journals  map[string]*objectJournal
+	callbacks []ObjectCallback
+	signer    *MessageSigner
+	mtx       sync.Mutex
+}
+
+func NewObjectTransfer(bus Bus) *ObjectTransfer {
+	ot := new(ObjectTransfer)
+	ot.bus = bus
+	ot.subject = "objects"
+	ot.origin = "objects.resend." + uuid.New().String()
+	ot.spool = path.Join(os.TempDir(), "ncd-objects")
+	ot.chunksize = OBJECT_CHUNK_SIZE
+	ot.timeout = 30 * time.Second
+	ot.expiry = 24 * time.Hour
+	ot.offered = make(map[string]*objectOffer)
+	ot.journals = make(map[string]*objectJournal)
+	ot.callbacks = make([]ObjectCallback, 0)
+
+	return ot
+}
+
+// SetSubject sets the bus subject for the object transfers. Default is "objects".
+func (ot *ObjectTransfer) SetSubject(subject string) *ObjectTransfer {
+	ot.subject = subject
+	return ot
+}
+
+// SetSpoolDir sets a directory, where incoming objects are assembled and stored.
+func (ot *ObjectTransfer) SetSpoolDir(spool string) *ObjectTransfer {
+	ot.spool = spool
+	return ot
+}
+
+// SetChunkSize sets the size of one chunk in bytes
+func (ot *ObjectTransfer) SetChunkSize(size int) *ObjectTransfer {
+	if size > 0 {
+		ot.chunksize = size
+	}
+	return ot
+}
+
+// SetResumeTimeout sets for how long an incomplete transfer is idle before missing chunks are requested again.
+func (ot *ObjectTransfer) SetResumeTimeout(timeout time.Duration) *ObjectTransfer {
+	ot.timeout = timeout
+	return ot
+}
+
+// SetExpiry sets for how long an incomplete transfer or an offered object is kept without any progress.
+// Default is 24 hours.
+func (ot *ObjectTransfer) SetExpiry(expiry time.Duration) *ObjectTransfer {
+	if expiry > 0 {
+		ot.expiry = expiry
+	}
+	return ot
+}
+
+// SetSigner sets the MessageSigner, signing outgoing and verifying incoming frames
+func (ot *ObjectTransfer) SetSigner(signer *MessageSigner) *ObjectTransfer {
+	ot.signer = signer
+	return ot
+}
+
+// AddCallback adds a callback, called on each completely received object
+func (ot *ObjectTransfer) AddCallback(callback ObjectCallback) *ObjectTransfer {
+	ot.callbacks = append(ot.callbacks, callback)
+	return ot
+}
+
+// Start subscribes to the transfer subjects and resumes transfers, left from the previous run.
+func (ot *ObjectTransfer) Start() error {
+	if ot.signer == nil || ot.signer.PublicKey() == "" {
+		return errors.New("object transfer has no node key to sign the frames")
+	}
+	if err := os.MkdirAll(ot.spool, 0700); err != nil {
+		return err
+	}
+	if _, err := ot.bus.Subscribe(ot.subject, ot.onFrame); err != nil {
+		return err
+	}
+	if _, err := ot.bus.Subscribe(ot.origin, ot.onFrame); err != nil {
+		return err
+	}
+	ot.loadJournals()
+	go ot.resumeMonitor()
+
+	return nil
+}
+
+// Send an object file to all the nodes under a given topic. Returns object Id.
+func (ot *ObjectTransfer) Send(filename string, topic string) (string, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	checksum, err := ot.fileChecksum(filename)
+	if err != nil {
+		return "", err
+	}
+
+	info := &ObjectInfo{
+		Id:        uuid.New().String(),
+		Name:      filepath.Base(filename),
+		Topic:     topic,
+		Size:      stat.Size(),
+		Checksum:  checksum,
+		ChunkSize: ot.chunksize,
+		Total:     int((stat.Size() + int64(ot.chunksize) - 1) / int64(ot.chunksize)),
+		Origin:    ot.origin,
+	}
+
+	ot.mtx.Lock()
+	ot.offered[info.Id] = &objectOffer{filename: filename, touched: time.Now()}
+	ot.mtx.Unlock()
+
+	if err := ot.publish(ot.subject, &ObjectFrame{Kind: OBJ_OFFER, Id: info.Id, Info: info}); err != nil {
+		return "", err
+	}
+
+	seqs := make([]int, info.Total)
+	for idx := range seqs {
+		seqs[idx] = idx
+	}
+
+	return info.Id, ot.sendChunks(info.Id, filename, seqs)
+}
+
+// Forget removes an offered object from the sender registry, so it won't be resent anymore.
+func (ot *ObjectTransfer) Forget(id string) {
+	ot.mtx.Lock()
+	delete(ot.offered, id)
+	ot.mtx.Unlock()
+}
+
+// Publish chunks by their sequence numbers
+func (ot *ObjectTransfer) sendChunks(id string, filename string, seqs []int) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	buff := make([]byte, ot.chunksize)
+	for _, seq := range seqs {
+		size, err := fh.ReadAt(buff, int64(seq)*int64(ot.chunksize))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		sum := sha256.Sum256(buff[:size])
+		frame := &ObjectFrame{Kind: OBJ_CHUNK, Id: id, Seq: seq, Checksum: hex.EncodeToString(sum[:]), Data: buff[:size]}
+		if err := ot.publish(ot.subject, frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sign, serialise and publish the frame
+func (ot *ObjectTransfer) publish(subject string, frame *ObjectFrame) error {
+	if err := ot.signer.SignFrame(frame); err != nil {
+		return err
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return ot.bus.Publish(subject, data)
+}
+
+// Dispatch incoming frames
+func (ot *ObjectTransfer) onFrame(m *BusMsg) {
+	frame := new(ObjectFrame)
+	if err := json.Unmarshal(m.Data, frame); err != nil {
+		log.Println("Object transfer: wrong frame -", err.Error())
+		return
+	}
+	if !validObjectId(frame.Id) {
+		log.Printf("Object transfer: wrong object Id '%s'", frame.Id)
+		return
+	}
+	if err := ot.signer.VerifyFrame(frame); err != nil {
+		log.Println("Object transfer: frame rejected -", err.Error())
+		return
+	}
+
+	var err error
+	switch frame.Kind {
+	case OBJ_OFFER:
+		err = ot.onOffer(frame)
+	case OBJ_CHUNK:
+		err = ot.onChunk(frame)
+	case OBJ_RESEND:
+		err = ot.onResend(frame)
+	default:
+		err = fmt.Errorf("unknown frame kind '%s'", frame.Kind)
+	}
+	if err != nil {
+		log.Println("Object transfer:", err.Error())
+	}
+}
+
+// Register an incoming object
+func (ot *ObjectTransfer) onOffer(frame *ObjectFrame) error {
+	if frame.Info == nil {
+		return fmt.Errorf("offer %s has no object info", frame.Id)
+	}
+	if err := checkObjectInfo(frame.Id, frame.Info); err != nil {
+		return err
+	}
+
+	ot.mtx.Lock()
+	defer ot.mtx.Unlock()
+
+	if _, ex := ot.offered[frame.Id]; ex {
+		return nil // Own object
+	}
+	if _, ex := ot.journals[frame.Id]; ex {
+		return nil
+	}
+
+	journal := &objectJournal{Info: frame.Info, Sender: frame.Signer, Received: make(map[int]bool), Updated: time.Now(), Progress: time.Now()}
+	ot.journals[frame.Id] = journal
+
+	// Empty object is complete right away
+	if frame.Info.Total == 0 {
+		return ot.complete(journal)
+	}
+
+	return ot.saveJournal(journal)
+}
+
+// Write a chunk to its offset in the spool file
+func (ot *ObjectTransfer) onChunk(frame *ObjectFrame) error {
+	ot.mtx.Lock()
+	defer ot.mtx.Unlock()
+
+	journal, ex := ot.journals[frame.Id]
+	if !ex || journal.Received[frame.Seq] {
+		return nil // Not ours, own or a duplicate
+	}
+	if frame.Signer != journal.Sender {
+		return fmt.Errorf("chunk %d of object %s is sent by '%s', but offered by '%s'", frame.Seq, frame.Id, frame.Signer, journal.Sender)
+	}
+	if frame.Seq < 0 || frame.Seq >= journal.Info.Total {
+		return fmt.Errorf("chunk %d is out of range for object %s", frame.Seq, frame.Id)
+	}
+	if len(frame.Data) > journal.Info.ChunkSize {
+		return fmt.Errorf("chunk %d of object %s is larger than the chunk size", frame.Seq, frame.Id)
+	}
+
+	sum := sha256.Sum256(frame.Data)
+	if hex.EncodeToString(sum[:]) != frame.Checksum {
+		return fmt.Errorf("chunk %d of object %s is corrupted, will be requested again", frame.Seq, frame.Id)
+	}
+
+	fh, err := os.OpenFile(ot.partPath(frame.Id), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fh.WriteAt(frame.Data, int64(frame.Seq)*int64(journal.Info.ChunkSize))
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	journal.Received[frame.Seq] = true
+	journal.Updated = time.Now()
+	journal.Progress = journal.Updated
+	if len(journal.Received) == journal.Info.Total {
+		return ot.complete(journal)
+	}
+
+	return ot.saveJournal(journal)
+}
+
+// Resend missing chunks of an offered object
+func (ot *ObjectTransfer) onResend(frame *ObjectFrame) error {
+	ot.mtx.Lock()
+	offer, ex := ot.offered[frame.Id]
+	if ex {
+		offer.touched = time.Now()
+	}
+	ot.mtx.Unlock()
+	if !ex {
+		return fmt.Errorf("resend of unknown object %s has been requested", frame.Id)
+	}
+	return ot.sendChunks(frame.Id, offer.filename, frame.Missing)
+}
+
+// Verify assembled object and hand it over to the callbacks. Requires lock.
+func (ot *ObjectTransfer) complete(journal *objectJournal) error {
+	id := journal.Info.Id
+	part := ot.partPath(id)
+	if journal.Info.Total == 0 {
+		if err := ioutil.WriteFile(part, []byte{}, 0600); err != nil {
+			return err
+		}
+	}
+
+	checksum, err := ot.fileChecksum(part)
+	if err != nil {
+		return err
+	}
+	if checksum != journal.Info.Checksum {
+		// Start over: the whole object is broken
+		journal.Received = make(map[int]bool)
+		os.Remove(part)
+		ot.saveJournal(journal)
+		return fmt.Errorf("object %s checksum mismatch, transfer restarted", id)
+	}
+
+	target := path.Join(ot.spool, id+"-"+filepath.Base(journal.Info.Name))
+	if err := os.Rename(part, target); err != nil {
+		return err
+	}
+	os.Remove(ot.journalPath(id))
+	delete(ot.journals, id)
+
+	log.Printf("Object transfer: received %s (%d bytes)", journal.Info.Name, journal.Info.Size)
+	for _, callback := range ot.callbacks {
+		go callback(journal.Info, target)
+	}
+
+	return nil
+}
+
+// Periodically request missing chunks of the stalled transfers and drop the expired ones
+func (ot *ObjectTransfer) resumeMonitor() {
+	for {
+		time.Sleep(ot.timeout)
+		ot.mtx.Lock()
+		ot.expire()
+		for _, journal := range ot.journals {
+			if time.Since(journal.Updated) < ot.timeout {
+				continue
+			}
+			missing := make([]int, 0)
+			for seq := 0; seq < journal.Info.Total; seq++ {
+				if !journal.Received[seq] {
+					missing = append(missing, seq)
+				}
+			}
+			journal.Updated = time.Now()
+			if err := ot.publish(journal.Info.Origin, &ObjectFrame{Kind: OBJ_RESEND, Id: journal.Info.Id, Missing: missing}); err != nil {
+				log.Println("Object transfer: cannot request resend:", err.Error())
+			}
+		}
+		ot.mtx.Unlock()
+	}
+}
+
+// Drop transfers and offers without any progress for longer than expiry. Requires lock.
+func (ot *ObjectTransfer) expire() {
+	for id, journal := range ot.journals {
+		if time.Since(journal.Progress) > ot.expiry {
+			log.Printf("Object transfer: %s (%s) has expired, dropping", journal.Info.Name, id)
+			os.Remove(ot.partPath(id))
+			os.Remove(ot.journalPath(id))
+			delete(ot.journals, id)
+		}
+	}
+	for id, offer := range ot.offered {
+		if time.Since(offer.touched) > ot.expiry {
+			delete(ot.offered, id)
+		}
+	}
+}
+
+// Load journals of the incomplete transfers from the spool
+func (ot *ObjectTransfer) loadJournals() {
+	matches, err := filepath.Glob(path.Join(ot.spool, "*.journal"))
+	if err != nil {
+		return
+	}
+
+	ot.mtx.Lock()
+	defer ot.mtx.Unlock()
+	for _, fname := range matches {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			log.Println("Object transfer: cannot read journal:", err.Error())
+			continue
+		}
+		journal := new(objectJournal)
+		id := strings.TrimSuffix(filepath.Base(fname), ".journal")
+		if err := json.Unmarshal(data, journal); err != nil || journal.Info == nil || checkObjectInfo(id, journal.Info) != nil {
+			log.Println("Object transfer: discarding broken journal", fname)
+			os.Remove(fname)
+			continue
+		}
+		if journal.Received == nil {
+			journal.Received = make(map[int]bool)
+		}
+		// Request missing chunks at the next monitor cycle
+		journal.Updated = time.Time{}
+		if journal.Progress.IsZero() {
+			journal.Progress = time.Now()
+		}
+		ot.journals[journal.Info.Id] = journal
+	}
+}
+
+// Persist the journal. Requires lock.
+func (ot *ObjectTransfer) saveJournal(journal *objectJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ot.journalPath(journal.Info.Id), data, 0600)
+}
+
+// Object Id is a part of the spool file names, so only canonical UUIDs are accepted
+func validObjectId(id string) bool {
+	uid, err := uuid.Parse(id)
+	return err == nil && uid.String() == id
+}
+
+// Check that the object info matches its frame Id and is consistent in sizes
+func checkObjectInfo(id string, info *ObjectInfo) error {
+	if !validObjectId(id) || info.Id != id {
+		return fmt.Errorf("object info Id '%s' does not match '%s'", info.Id, id)
+	}
+	if info.ChunkSize <= 0 || info.Size < 0 || info.Total < 0 {
+		return fmt.Errorf("object %s has wrong sizes", id)
+	}
+	// Chunks must cover the whole object, the last one being not empty
+	if int64(info.Total)*int64(info.ChunkSize) < info.Size || (info.Total > 0 && int64(info.Total-1)*int64(info.ChunkSize) >= info.Size) {
+		return fmt.Errorf("object %s of %d bytes cannot be in %d chunks of %d bytes", id, info.Size, info.Total, info.ChunkSize)
+	}
+	return nil
+}
+
+// Spool path of the object file. Id is always checked by validObjectId before.
+func (ot *ObjectTransfer) partPath(id string) string {
+	return path.Join(ot.spool, id+".part")
+}
+
+func (ot *ObjectTransfer) journalPath(id string) string {
+	return path.Join(ot.spool, id+".journal")
+}
+
+// Calculate SHA-256 checksum of a file
+func (ot *ObjectTransfer) fileChecksum(filename string) (string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
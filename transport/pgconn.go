@@ -0,0 +1,127 @@
+/*
+Connection options of the database.
+
+Connection string is built from the listener options, or from a connection
+URI. Values are quoted, so passwords and paths can contain anything. Without
+a password it is looked up in the password file of the listener, or by the
+driver in PGPASSFILE or ~/.pgpass. Host, which is a directory, is a Unix socket.
+
+All libpq SSL modes are supported. The driver knows only "disable", "require",
+"verify-ca" and "verify-full", so "allow" and "prefer" are tried as one of them
+and then another.
+*/
+
+package ncdtransport
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	PG_SSL_DISABLE     = "disable"
+	PG_SSL_ALLOW       = "allow"
+	PG_SSL_PREFER      = "prefer"
+	PG_SSL_REQUIRE     = "require"
+	PG_SSL_VERIFY_CA   = "verify-ca"
+	PG_SSL_VERIFY_FULL = "verify-full"
+)
+
+// SSL modes of the driver to try, in order
+func pgSSLAttempts(mode string) []string {
+	switch mode {
+	case PG_SSL_ALLOW:
+		return []string{PG_SSL_DISABLE, PG_SSL_REQUIRE}
+	case PG_SSL_PREFER, "":
+		return []string{PG_SSL_REQUIRE, PG_SSL_DISABLE}
+	default:
+		return []string{mode}
+	}
+}
+
+// Connection string in "key=value" form
+type pgDSN struct {
+	options []string
+}
+
+// Add the option with the quoted value. Empty values are skipped.
+func (dsn *pgDSN) add(key string, value string) *pgDSN {
+	if value != "" {
+		value = strings.Replace(value, `\`, `\\`, -1)
+		value = strings.Replace(value, `'`, `\'`, -1)
+		dsn.options = append(dsn.options, key+"='"+value+"'")
+	}
+	return dsn
+}
+
+func (dsn *pgDSN) String() string {
+	return strings.Join(dsn.options, " ")
+}
+
+// Look up the password in the password file: "hostname:port:database:username:password" per line,
+// where "*" matches anything. Unix socket host is matched as "localhost".
+// Returns empty string if nothing matches.
+func pgPassLookup(passfile string, host string, port int, dbname string, user string) (string, error) {
+	if err := checkSecretFile("Password", passfile); err != nil {
+		return "", err
+	}
+	fh, err := os.Open(passfile)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	if strings.HasPrefix(host, "/") {
+		host = "localhost"
+	}
+	wanted := []string{host, strconv.Itoa(port), dbname, user}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := pgPassFields(line)
+		if len(fields) != 5 {
+			continue
+		}
+		matches := true
+		for idx, value := range wanted {
+			if fields[idx] != "*" && fields[idx] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fields[4], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// Split the password file line by colons, except escaped ones
+func pgPassFields(line string) []string {
+	fields := make([]string, 0, 5)
+	var field strings.Builder
+	for idx := 0; idx < len(line); idx++ {
+		switch line[idx] {
+		case '\\':
+			if idx+1 < len(line) {
+				idx++
+				field.WriteByte(line[idx])
+			}
+		case ':':
+			if len(fields) < 4 {
+				fields = append(fields, field.String())
+				field.Reset()
+			} else {
+				field.WriteByte(':')
+			}
+		default:
+			field.WriteByte(line[idx])
+		}
+	}
+	return append(fields, field.String())
+}
@@ -0,0 +1,211 @@
+/*
+Coalescing of repeated changes of the same row.
+
+A single edit in the Uyuni web UI can update the same row several times in a
+row, and each change would be mapped (e.g. with an XML-RPC call) and sent to
+all the nodes. Debouncer holds the first change of a row for the debounce
+window of its table, and replaces it with the later changes of the same row
+within the window. After the window only the latest state is passed on.
+
+The operation is kept: updates of an inserted row are passed on as an insert
+of the latest state, and a delete replaces the held insert or update. A row,
+inserted after its held delete, would lose the delete, so then the held change
+is passed on right away, and the new one is held instead.
+
+Rows are identified by the values of the primary key columns. Changes of the
+tables without the window, or without the primary key in the data, are passed
+through immediately. Held changes are no longer a part of their transaction.
+Changes from the event log are read again after a restart, as its checkpoint is
+not persisted past the oldest held change (see Oldest). Changes from the other
+sources are lost, if ncd stops within the window.
+*/
+
+package ncdtransport
+
+import (
+	"sync"
+	"time"
+)
+
+// PgRowKeyFunc returns identity of the changed row, or empty string if it has none
+type PgRowKeyFunc func(event map[string]interface{}) string
+
+type pgHeldEvent struct {
+	event map[string]interface{}
+	seq   int64 // Event log sequence number of the first held change, if any
+	timer *time.Timer
+}
+
+type PgDebouncer struct {
+	window   time.Duration
+	tables   map[string]time.Duration
+	keyfunc  PgRowKeyFunc
+	held     map[string]*pgHeldEvent
+	inflight map[int64]int // Sequence numbers of the released events, still being passed on
+	mtx      sync.Mutex
+}
+
+func NewPgDebouncer() *PgDebouncer {
+	pd := new(PgDebouncer)
+	pd.tables = make(map[string]time.Duration)
+	pd.held = make(map[string]*pgHeldEvent)
+	pd.inflight = make(map[int64]int)
+	return pd
+}
+
+// SetWindow sets the debounce window of all the tables. Zero turns it off.
+func (pd *PgDebouncer) SetWindow(window time.Duration) *PgDebouncer {
+	pd.window = window
+	return pd
+}
+
+// SetTableWindow sets the debounce window of the table, overriding the common one
+func (pd *PgDebouncer) SetTableWindow(table string, window time.Duration) *PgDebouncer {
+	pd.tables[table] = window
+	return pd
+}
+
+// SetKeyFunc sets the identity of the changed rows
+func (pd *PgDebouncer) SetKeyFunc(keyfunc PgRowKeyFunc) *PgDebouncer {
+	pd.keyfunc = keyfunc
+	return pd
+}
+
+// Enabled returns true, if any table has a debounce window
+func (pd *PgDebouncer) Enabled() bool {
+	if pd.window > 0 {
+		return true
+	}
+	for _, window := range pd.tables {
+		if window > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Debounce window of the table
+func (pd *PgDebouncer) tableWindow(table string) time.Duration {
+	if window, ex := pd.tables[table]; ex {
+		return window
+	}
+	return pd.window
+}
+
+// Hold the events, which should be debounced, and return the rest in order.
+// Held events are passed to the flush callback, one per batch, after their window.
+func (pd *PgDebouncer) Hold(events []map[string]interface{}, flush PgBatchCallback) []map[string]interface{} {
+	pd.mtx.Lock()
+	defer pd.mtx.Unlock()
+
+	pass := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		table, _ := event["table"].(string)
+		window := pd.tableWindow(table)
+		if window <= 0 {
+			pass = append(pass, event)
+			continue
+		}
+		var key string
+		if pd.keyfunc != nil {
+			key = pd.keyfunc(event)
+		}
+		if key == "" {
+			pass = append(pass, event)
+			continue
+		}
+		if held, ex := pd.held[key]; ex {
+			if merged := pgMergeEvents(held.event, event); merged != nil {
+				held.event = merged
+				continue
+			}
+			held.timer.Stop()
+			delete(pd.held, key)
+			pass = append(pass, held.event)
+		}
+		held := &pgHeldEvent{event: event}
+		held.seq, _ = event["seq"].(int64)
+		held.timer = time.AfterFunc(window, func() { pd.release(key, held, flush) })
+		pd.held[key] = held
+	}
+	return pass
+}
+
+// Oldest returns the lowest event log sequence number of the events, which are held
+// or still being passed on, or 0 if there are none.
+func (pd *PgDebouncer) Oldest() int64 {
+	pd.mtx.Lock()
+	defer pd.mtx.Unlock()
+
+	var oldest int64
+	for _, held := range pd.held {
+		if held.seq > 0 && (oldest == 0 || held.seq < oldest) {
+			oldest = held.seq
+		}
+	}
+	for seq := range pd.inflight {
+		if seq > 0 && (oldest == 0 || seq < oldest) {
+			oldest = seq
+		}
+	}
+	return oldest
+}
+
+// Merge the later change of the row into the held one. Returns nil, if they cannot be merged.
+func pgMergeEvents(held map[string]interface{}, event map[string]interface{}) map[string]interface{} {
+	first, _ := held["action"].(string)
+	next, _ := event["action"].(string)
+	switch {
+	case first == next || next == "DELETE" && first != "DELETE":
+		return event
+	case next == "UPDATE" && first == "INSERT":
+		merged := make(map[string]interface{}, len(event))
+		for name, value := range event {
+			merged[name] = value
+		}
+		merged["action"] = first
+		return merged
+	}
+	return nil
+}
+
+// Pass the held event on, unless it has been already passed
+func (pd *PgDebouncer) release(key string, held *pgHeldEvent, flush PgBatchCallback) {
+	pd.mtx.Lock()
+	ex := pd.held[key] == held
+	if ex {
+		delete(pd.held, key)
+		pd.inflight[held.seq]++
+	}
+	pd.mtx.Unlock()
+	if ex {
+		pd.pass(held, flush)
+	}
+}
+
+// Flush passes all the held events on immediately
+func (pd *PgDebouncer) Flush(flush PgBatchCallback) {
+	pd.mtx.Lock()
+	events := make([]*pgHeldEvent, 0, len(pd.held))
+	for key, held := range pd.held {
+		held.timer.Stop()
+		events = append(events, held)
+		pd.inflight[held.seq]++
+		delete(pd.held, key)
+	}
+	pd.mtx.Unlock()
+	for _, held := range events {
+		pd.pass(held, flush)
+	}
+}
+
+// Pass the released event to the callback, which returns once the event is processed
+func (pd *PgDebouncer) pass(held *pgHeldEvent, flush PgBatchCallback) {
+	flush([]map[string]interface{}{held.event})
+
+	pd.mtx.Lock()
+	if pd.inflight[held.seq]--; pd.inflight[held.seq] <= 0 {
+		delete(pd.inflight, held.seq)
+	}
+	pd.mtx.Unlock()
+}
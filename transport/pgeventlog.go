@@ -0,0 +1,263 @@
+/*
+Gap-free reader of the database event log.
+
+Triggers append every change to the "ncd_event_log" table with a sequence
+number, and NOTIFY is just a wake-up. The reader processes everything after
+its checkpoint, which is persisted in the "ncd_event_checkpoint" table per
+consumer, so changes made while ncd was down or disconnected are read on start.
+Events of one transaction are passed together, in order.
+
+Sequence numbers are taken before the transaction commits, so a later event
+can become visible earlier than a previous one. A gap is therefore waited for
+up to the gap timeout: either the event appears, or its transaction was rolled
+back and the gap is skipped.
+
+Persisted checkpoint does not pass the events, which are read but still held
+by the listener (debounced or queued to the workers), so they are read again
+after a restart.
+Delivery is therefore at least once: a restart can repeat some events.
+*/
+
+package ncdtransport
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	PG_EVENT_LOG        = "ncd_event_log"
+	PG_EVENT_CHECKPOINT = "ncd_event_checkpoint"
+)
+
+type PgEventLog struct {
+	db         *sql.DB
+	consumer   string
+	checkpoint int64
+	saved      int64
+	held       func() int64
+	batch      int
+	prune      bool
+	gaptimeout time.Duration
+	gapseq     int64
+	gapsince   time.Time
+	delivered  map[int64]int64 // Transactions, passed ahead of the checkpoint, to their last sequence
+}
+
+func NewPgEventLog(consumer string) *PgEventLog {
+	pl := new(PgEventLog)
+	pl.consumer = consumer
+	pl.batch = 1000
+	pl.prune = true
+	pl.gaptimeout = 30 * time.Second
+	pl.delivered = make(map[int64]int64)
+	return pl
+}
+
+// SetConsumer sets the name, under which the checkpoint is stored
+func (pl *PgEventLog) SetConsumer(consumer string) *PgEventLog {
+	pl.consumer = consumer
+	return pl
+}
+
+// SetBatch sets how many events are read at once
+func (pl *PgEventLog) SetBatch(batch int) *PgEventLog {
+	if batch > 0 {
+		pl.batch = batch
+	}
+	return pl
+}
+
+// SetPrune turns on or off deleting events, which are read by all consumers
+func (pl *PgEventLog) SetPrune(prune bool) *PgEventLog {
+	pl.prune = prune
+	return pl
+}
+
+// SetGapTimeout sets how long a gap in the sequence is waited for, before it is skipped
+func (pl *PgEventLog) SetGapTimeout(timeout time.Duration) *PgEventLog {
+	pl.gaptimeout = timeout
+	return pl
+}
+
+// SetHeld sets the function, returning the lowest sequence number of the events,
+// which are read, but not processed yet, or 0 if there are none
+func (pl *PgEventLog) SetHeld(held func() int64) *PgEventLog {
+	pl.held = held
+	return pl
+}
+
+// Checkpoint returns the last processed sequence number
+func (pl *PgEventLog) Checkpoint() int64 {
+	return pl.checkpoint
+}
+
+// Open the event log on the database and load the checkpoint
+func (pl *PgEventLog) Open(db *sql.DB) error {
+	pl.db = db
+	err := db.QueryRow("SELECT seq FROM "+PG_EVENT_CHECKPOINT+" WHERE consumer = $1", pl.consumer).Scan(&pl.checkpoint)
+	if err == sql.ErrNoRows {
+		pl.checkpoint = 0
+		err = nil
+	}
+	if err == nil {
+		pl.saved = pl.checkpoint
+		log.Printf("Reading event log as '%s' after %d", pl.consumer, pl.checkpoint)
+	}
+	return err
+}
+
+// SetDB replaces the database connection, e.g. after reconnect. The checkpoint is kept,
+// as the saved one is behind the events, which are still held.
+func (pl *PgEventLog) SetDB(db *sql.DB) *PgEventLog {
+	pl.db = db
+	return pl
+}
+
+// Read all events after the checkpoint and pass them to the handler in order,
+// grouped by transaction. Checkpoint is saved after each batch.
+func (pl *PgEventLog) Read(handler func(events []map[string]interface{})) error {
+	for {
+		_, more, err := pl.readBatch(handler)
+		// Also held events, processed since the last read
+		if serr := pl.save(); serr != nil && err == nil {
+			err = serr
+		}
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// Row of the event log
+type pgLogRow struct {
+	seq    int64
+	table  string
+	action string
+	raw    []byte
+	txid   sql.NullInt64
+}
+
+// Query rows of the event log
+func (pl *PgEventLog) query(query string, args ...interface{}) ([]*pgLogRow, error) {
+	rows, err := pl.db.Query("SELECT seq, tbl, action, data, txid FROM "+PG_EVENT_LOG+" WHERE "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*pgLogRow, 0)
+	for rows.Next() {
+		row := new(pgLogRow)
+		if err := rows.Scan(&row.seq, &row.table, &row.action, &row.raw, &row.txid); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// Convert rows to events
+func (pl *PgEventLog) events(rows []*pgLogRow) []map[string]interface{} {
+	events := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		var data interface{}
+		if err := json.Unmarshal(row.raw, &data); err != nil {
+			log.Printf("Event %d of '%s' skipped, wrong data: %s", row.seq, row.table, err.Error())
+			continue
+		}
+		event := map[string]interface{}{"table": row.table, "action": row.action, "data": data, "seq": row.seq}
+		if row.txid.Valid {
+			event["txid"] = row.txid.Int64
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Read one batch. Returns amount of processed events and if there might be more.
+// Transaction is committed at once, so when its first event is read,
+// all its events are there and are passed together.
+func (pl *PgEventLog) readBatch(handler func(events []map[string]interface{})) (int, bool, error) {
+	rows, err := pl.query("seq > $1 ORDER BY seq LIMIT $2", pl.checkpoint, pl.batch)
+	if err != nil {
+		return 0, false, err
+	}
+
+	count := 0
+	for _, row := range rows {
+		if !pl.gapClosed(row.seq) {
+			return count, false, nil
+		}
+		if _, done := pl.delivered[row.txid.Int64]; row.txid.Valid && !done {
+			group, err := pl.query("txid = $1 AND seq > $2 ORDER BY seq", row.txid.Int64, pl.checkpoint)
+			if err != nil {
+				return count, false, err
+			}
+			if len(group) > 0 {
+				pl.delivered[row.txid.Int64] = group[len(group)-1].seq
+			}
+			if events := pl.events(group); len(events) > 0 {
+				handler(events)
+			}
+		} else if !row.txid.Valid {
+			if events := pl.events([]*pgLogRow{row}); len(events) > 0 {
+				handler(events)
+			}
+		}
+		pl.checkpoint = row.seq
+		count++
+	}
+
+	// Forget transactions, which are entirely behind the checkpoint
+	for txid, last := range pl.delivered {
+		if last <= pl.checkpoint {
+			delete(pl.delivered, txid)
+		}
+	}
+	return count, len(rows) == pl.batch, nil
+}
+
+// Check if the event can be processed after the checkpoint, or a gap before it should be waited for
+func (pl *PgEventLog) gapClosed(seq int64) bool {
+	if seq == pl.checkpoint+1 || pl.checkpoint == 0 {
+		pl.gapseq = 0
+		return true
+	}
+	if pl.gapseq != seq {
+		pl.gapseq = seq
+		pl.gapsince = time.Now()
+	}
+	if time.Since(pl.gapsince) < pl.gaptimeout {
+		return false
+	}
+	log.Printf("Events [%d-%d] did not appear within %s, skipping them", pl.checkpoint+1, seq-1, pl.gaptimeout)
+	pl.gapseq = 0
+	return true
+}
+
+// Persist the checkpoint before the held events and prune events, read by all consumers
+func (pl *PgEventLog) save() error {
+	checkpoint := pl.checkpoint
+	if pl.held != nil {
+		if seq := pl.held(); seq > 0 && seq <= checkpoint {
+			checkpoint = seq - 1
+		}
+	}
+	if pl.db == nil || checkpoint == pl.saved {
+		return nil
+	}
+	if _, err := pl.db.Exec("INSERT INTO "+PG_EVENT_CHECKPOINT+" (consumer, seq) VALUES ($1, $2) "+
+		"ON CONFLICT (consumer) DO UPDATE SET seq = EXCLUDED.seq", pl.consumer, checkpoint); err != nil {
+		return err
+	}
+	pl.saved = checkpoint
+	if pl.prune {
+		if _, err := pl.db.Exec("DELETE FROM " + PG_EVENT_LOG + " WHERE seq <= (SELECT min(seq) FROM " + PG_EVENT_CHECKPOINT + ")"); err != nil {
+			log.Println("Cannot prune event log:", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+/*
+Logical decoding change source.
+
+Instead of triggers in the Uyuni schema, row changes are read from a logical
+replication slot, decoded either by wal2json or by the built-in pgoutput
+plugin, and turned into the same {table, action, data} events as triggers make.
+
+Changes are peeked from the slot in batches of whole transactions and the slot
+is advanced only after they were processed (see SetSync), so nothing is lost
+across restarts.
+Changes of one transaction are passed together, in order.
+The slot is created on the first start. The pgoutput plugin also needs a
+publication, which is created as well, if missing. Both require a user with
+the REPLICATION attribute, and PostgreSQL 11 or newer with wal_level=logical.
+
+Deleted rows have only the replica identity columns (primary key by default),
+unless the table has REPLICA IDENTITY FULL.
+*/
+
+package ncdtransport
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	PG_PLUGIN_WAL2JSON = "wal2json"
+	PG_PLUGIN_PGOUTPUT = "pgoutput"
+)
+
+// Change of wal2json format version 2
+type wal2jsonChange struct {
+	Action   string
+	Xid      int64
+	Table    string
+	Columns  []wal2jsonColumn
+	Identity []wal2jsonColumn
+}
+
+type wal2jsonColumn struct {
+	Name  string
+	Value interface{}
+}
+
+// Relation of pgoutput protocol
+type pgRelation struct {
+	table   string
+	columns []string
+	types   []uint32
+}
+
+type PgLogicalSource struct {
+	db          *sql.DB
+	slot        string
+	plugin      string
+	publication string
+	tables      []string
+	batch       int
+	relations   map[uint32]*pgRelation
+	txid        int64 // Transaction being decoded
+	sync        func()
+}
+
+func NewPgLogicalSource(slot string) *PgLogicalSource {
+	pls := new(PgLogicalSource)
+	pls.slot = slot
+	pls.plugin = PG_PLUGIN_WAL2JSON
+	pls.publication = slot
+	pls.tables = make([]string, 0)
+	pls.batch = 1000
+	pls.relations = make(map[uint32]*pgRelation)
+	return pls
+}
+
+// SetPlugin sets the output plugin: "wal2json" (default) or "pgoutput"
+func (pls *PgLogicalSource) SetPlugin(plugin string) error {
+	switch plugin {
+	case PG_PLUGIN_WAL2JSON, PG_PLUGIN_PGOUTPUT:
+		pls.plugin = plugin
+		return nil
+	}
+	return fmt.Errorf("unknown logical decoding plugin: %s", plugin)
+}
+
+// SetPublication sets the publication name for pgoutput. Default is the slot name.
+func (pls *PgLogicalSource) SetPublication(publication string) *PgLogicalSource {
+	if publication != "" {
+		pls.publication = publication
+	}
+	return pls
+}
+
+// AddTables adds comma-separated tables to capture. Default is all tables.
+func (pls *PgLogicalSource) AddTables(tables string) *PgLogicalSource {
+	for _, table := range strings.Split(tables, ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			pls.tables = append(pls.tables, table)
+		}
+	}
+	return pls
+}
+
+// SetBatch sets how many changes are peeked at once
+func (pls *PgLogicalSource) SetBatch(batch int) *PgLogicalSource {
+	if batch > 0 {
+		pls.batch = batch
+	}
+	return pls
+}
+
+// SetSync sets the function, called before the slot is advanced, which returns
+// once the changes, passed to the handler, are processed
+func (pls *PgLogicalSource) SetSync(sync func()) *PgLogicalSource {
+	pls.sync = sync
+	return pls
+}
+
+// Open the source on the database, creating the slot and the publication, if missing
+func (pls *PgLogicalSource) Open(db *sql.DB) error {
+	pls.db = db
+	if pls.plugin == PG_PLUGIN_PGOUTPUT {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", pls.publication).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			target := "ALL TABLES"
+			if len(pls.tables) > 0 {
+				quoted := make([]string, len(pls.tables))
+				for idx, table := range pls.tables {
+					quoted[idx] = pgQuoteTable(table)
+				}
+				target = "TABLE " + strings.Join(quoted, ", ")
+			}
+			if _, err := db.Exec("CREATE PUBLICATION " + pq.QuoteIdentifier(pls.publication) + " FOR " + target); err != nil {
+				return fmt.Errorf("cannot create publication %s: %s", pls.publication, err.Error())
+			}
+			log.Printf("Created publication %s for %s", pls.publication, target)
+		}
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", pls.slot).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.Exec("SELECT pg_create_logical_replication_slot($1, $2)", pls.slot, pls.plugin); err != nil {
+			return fmt.Errorf("cannot create replication slot %s: %s", pls.slot, err.Error())
+		}
+		log.Printf("Created replication slot %s with %s", pls.slot, pls.plugin)
+	}
+	return nil
+}
+
+// Read all pending changes and pass them to the handler in order, grouped by transaction
+func (pls *PgLogicalSource) Read(handler func(events []map[string]interface{})) error {
+	for {
+		rows, commit, err := pls.readBatch(handler)
+		if err != nil {
+			return err
+		}
+		if commit != "" {
+			if pls.sync != nil {
+				pls.sync()
+			}
+			if _, err := pls.db.Exec("SELECT pg_replication_slot_advance($1, $2::pg_lsn)", pls.slot, commit); err != nil {
+				return err
+			}
+		}
+		if rows < pls.batch || commit == "" {
+			return nil
+		}
+	}
+}
+
+// Peek one batch of changes. Returns amount of rows and LSN of the last commit.
+func (pls *PgLogicalSource) readBatch(handler func(events []map[string]interface{})) (int, string, error) {
+	var query string
+	args := []interface{}{pls.slot, pls.batch}
+	switch pls.plugin {
+	case PG_PLUGIN_WAL2JSON:
+		query = "SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2, 'format-version', '2', 'include-transaction', 'true', 'include-xids', 'true'"
+		if len(pls.tables) > 0 {
+			filter := make([]string, len(pls.tables))
+			for idx, table := range pls.tables {
+				if !strings.Contains(table, ".") {
+					table = "*." + table
+				}
+				filter[idx] = table
+			}
+			query += ", 'add-tables', $3"
+			args = append(args, strings.Join(filter, ","))
+		}
+		query += ")"
+	case PG_PLUGIN_PGOUTPUT:
+		query = "SELECT lsn::text, data FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, 'proto_version', '1', 'publication_names', $3)"
+		args = append(args, pls.publication)
+	}
+
+	rows, err := pls.db.Query(query, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+
+	count := 0
+	commit := ""
+	events := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var lsn string
+		var data []byte
+		if err := rows.Scan(&lsn, &data); err != nil {
+			return count, "", err
+		}
+		count++
+
+		var event map[string]interface{}
+		var iscommit bool
+		if pls.plugin == PG_PLUGIN_WAL2JSON {
+			event, iscommit, err = pls.decodeWal2json(data)
+		} else {
+			event, iscommit, err = pls.decodePgoutput(data)
+		}
+		if err != nil {
+			log.Printf("Change at %s skipped: %s", lsn, err.Error())
+		} else if event != nil {
+			event["txid"] = pls.txid
+			events = append(events, event)
+		}
+		if iscommit {
+			if len(events) > 0 {
+				handler(events)
+				events = make([]map[string]interface{}, 0)
+			}
+			commit = lsn
+		}
+	}
+	return count, commit, rows.Err()
+}
+
+// Action name, as triggers have it
+func (pls *PgLogicalSource) action(code byte) string {
+	switch code {
+	case 'I':
+		return "INSERT"
+	case 'U':
+		return "UPDATE"
+	case 'D':
+		return "DELETE"
+	}
+	return ""
+}
+
+// Decode wal2json format version 2 change
+func (pls *PgLogicalSource) decodeWal2json(raw []byte) (map[string]interface{}, bool, error) {
+	// Numbers are kept in their text form, as the triggers have them
+	change := new(wal2jsonChange)
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(change); err != nil {
+		return nil, false, err
+	}
+	if change.Action == "" {
+		return nil, false, errors.New("no action")
+	}
+	if change.Action == "B" {
+		pls.txid = change.Xid
+	}
+	action := pls.action(change.Action[0])
+	if action == "" {
+		return nil, change.Action == "C", nil // Transaction boundaries, truncate, messages
+	}
+
+	data := make(map[string]interface{})
+	columns := change.Columns
+	if action == "DELETE" {
+		columns = change.Identity
+	}
+	for _, column := range columns {
+		data[column.Name] = column.Value
+	}
+	return map[string]interface{}{"table": change.Table, "action": action, "data": data}, false, nil
+}
+
+// Decode pgoutput protocol version 1 message
+func (pls *PgLogicalSource) decodePgoutput(raw []byte) (map[string]interface{}, bool, error) {
+	msg := &pgoutputReader{data: raw}
+	switch kind := msg.byte(); kind {
+	case 'B':
+		msg.bytes(16) // Final LSN and commit timestamp
+		pls.txid = int64(msg.uint32())
+		return nil, false, msg.err
+	case 'C':
+		return nil, true, nil
+	case 'R':
+		oid := msg.uint32()
+		rel := &pgRelation{}
+		msg.string() // Namespace
+		rel.table = msg.string()
+		msg.byte() // Replica identity
+		ncols := int(msg.uint16())
+		for idx := 0; idx < ncols && msg.err == nil; idx++ {
+			msg.byte() // Flags
+			rel.columns = append(rel.columns, msg.string())
+			rel.types = append(rel.types, msg.uint32())
+			msg.uint32() // Type modifier
+		}
+		if msg.err == nil {
+			pls.relations[oid] = rel
+		}
+		return nil, false, msg.err
+	case 'I', 'U', 'D':
+		oid := msg.uint32()
+		rel, ex := pls.relations[oid]
+		if !ex {
+			return nil, false, fmt.Errorf("unknown relation %d", oid)
+		}
+		tuple := msg.byte()
+		if kind == 'U' && (tuple == 'K' || tuple == 'O') {
+			pls.tuple(msg, rel, false) // Old row
+			tuple = msg.byte()
+		}
+		data := pls.tuple(msg, rel, tuple == 'K')
+		if msg.err != nil {
+			return nil, false, msg.err
+		}
+		return map[string]interface{}{"table": rel.table, "action": pls.action(kind), "data": data}, false, nil
+	}
+	return nil, false, nil // Origin, type, truncate
+}
+
+// Read tuple data of the relation. Key tuple has only key columns, others are null.
+func (pls *PgLogicalSource) tuple(msg *pgoutputReader, rel *pgRelation, keyonly bool) map[string]interface{} {
+	data := make(map[string]interface{})
+	ncols := int(msg.uint16())
+	for idx := 0; idx < ncols && msg.err == nil; idx++ {
+		var name string
+		var oid uint32
+		if idx < len(rel.columns) {
+			name, oid = rel.columns[idx], rel.types[idx]
+		}
+		switch msg.byte() {
+		case 'n':
+			if !keyonly {
+				data[name] = nil
+			}
+		case 't':
+			data[name] = pls.value(oid, string(msg.bytes(int(msg.uint32()))))
+		}
+		// 'u': unchanged TOAST value is not sent
+	}
+	return data
+}
+
+// Convert text value of the type to what row_to_json would give
+func (pls *PgLogicalSource) value(oid uint32, text string) interface{} {
+	switch oid {
+	case 16: // bool
+		return text == "t"
+	case 20, 21, 23, 700, 701, 1700: // int8, int2, int4, float4, float8, numeric
+		// Kept in text form for precision, NaN and Infinity stay strings
+		if _, err := strconv.ParseFloat(text, 64); err == nil && json.Valid([]byte(text)) {
+			return json.Number(text)
+		}
+	case 114, 3802: // json, jsonb
+		var data interface{}
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err == nil {
+			return data
+		}
+	case 1114, 1184: // timestamp, timestamptz
+		return strings.Replace(text, " ", "T", 1)
+	}
+	return text
+}
+
+// Reader of pgoutput binary messages. The first error stops reading.
+type pgoutputReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *pgoutputReader) bytes(size int) []byte {
+	if r.err != nil || size < 0 || r.pos+size > len(r.data) {
+		if r.err == nil {
+			r.err = errors.New("truncated pgoutput message")
+		}
+		if size > 4 || size < 0 {
+			size = 4
+		}
+		return make([]byte, size) // Enough for the fixed size fields
+
+	}
+	buff := r.data[r.pos : r.pos+size]
+	r.pos += size
+	return buff
+}
+
+func (r *pgoutputReader) byte() byte {
+	return r.bytes(1)[0]
+}
+
+func (r *pgoutputReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.bytes(2))
+}
+
+func (r *pgoutputReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.bytes(4))
+}
+
+func (r *pgoutputReader) string() string {
+	if r.err == nil {
+		if end := strings.IndexByte(string(r.data[r.pos:]), 0); end >= 0 {
+			str := string(r.data[r.pos : r.pos+end])
+			r.pos += end + 1
+			return str
+		}
+		r.err = errors.New("truncated pgoutput message")
+	}
+	return ""
+}
@@ -0,0 +1,348 @@
+/*
+Per-table column rules of the captured changes.
+
+Rules file has one table per line with its rules, applied in the given order:
+
+	rhnchannel include=id,label,name,parent_channel,org_id debounce=2000
+	web_contact exclude=password hash=login
+	rhnchannelfamily channel=families
+
+A table without rules is captured with all its columns. The "channel" is the
+notification channel of the table, "cluster" by default. The "debounce" is the
+window in milliseconds, within which repeated changes of the same row are
+coalesced by the listener. Rules are passed to
+the triggers as arguments, so the database sends only what the mappers need.
+Changes from the logical decoding do not go through triggers, so the same
+rules are applied to them by the listener. Hashes are taken from the same
+text as "data->>column" gives in the triggers, so both match.
+
+Tables, columns and channels are plain lowercase SQL identifiers, as they are
+quoted in the generated SQL.
+*/
+
+package ncdtransport
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PG_RULE_INCLUDE  = "include"
+	PG_RULE_EXCLUDE  = "exclude"
+	PG_RULE_HASH     = "hash"
+	PG_RULE_CHANNEL  = "channel"
+	PG_RULE_DEBOUNCE = "debounce"
+)
+
+var pgIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// Check that the name is a plain SQL identifier, or "schema.table", if qualified
+func pgCheckIdentifier(name string, qualified bool) error {
+	parts := []string{name}
+	if qualified {
+		parts = strings.SplitN(name, ".", 2)
+	}
+	for _, part := range parts {
+		if len(part) > 63 || !pgIdentifier.MatchString(part) {
+			return fmt.Errorf("'%s' is not a valid lowercase SQL identifier", name)
+		}
+	}
+	return nil
+}
+
+// Quote each part of the possibly schema-qualified table
+func pgQuoteTable(table string) string {
+	parts := strings.SplitN(table, ".", 2)
+	for idx, part := range parts {
+		parts[idx] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+type PgColumnRule struct {
+	Kind    string
+	Columns []string
+}
+
+// Trigger argument of the rule
+func (rule *PgColumnRule) String() string {
+	return rule.Kind + "=" + strings.Join(rule.Columns, ",")
+}
+
+type PgColumnRules struct {
+	tables []string
+	rules  map[string][]*PgColumnRule
+}
+
+func NewPgColumnRules() *PgColumnRules {
+	pcr := new(PgColumnRules)
+	pcr.tables = make([]string, 0)
+	pcr.rules = make(map[string][]*PgColumnRule)
+	return pcr
+}
+
+// LoadRules loads tables and their rules from the file
+func (pcr *PgColumnRules) LoadRules(fpath string) error {
+	fh, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for lnum := 1; scanner.Scan(); lnum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if err := pgCheckIdentifier(fields[0], true); err != nil {
+			return fmt.Errorf("%s:%d: table %s", fpath, lnum, err.Error())
+		}
+		pcr.AddTable(fields[0])
+		for _, field := range fields[1:] {
+			kind := strings.SplitN(field, "=", 2)
+			if len(kind) != 2 {
+				return fmt.Errorf("%s:%d: rule should be <kind>=<columns>, got '%s'", fpath, lnum, field)
+			}
+			if err := pcr.AddRule(fields[0], kind[0], kind[1]); err != nil {
+				return fmt.Errorf("%s:%d: %s", fpath, lnum, err.Error())
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// AddTable adds a table to capture
+func (pcr *PgColumnRules) AddTable(table string) *PgColumnRules {
+	if _, ex := pcr.rules[table]; !ex {
+		pcr.tables = append(pcr.tables, table)
+		pcr.rules[table] = make([]*PgColumnRule, 0)
+	}
+	return pcr
+}
+
+// AddRule adds a rule with comma-separated columns to the table
+func (pcr *PgColumnRules) AddRule(table string, kind string, columns string) error {
+	switch kind {
+	case PG_RULE_INCLUDE, PG_RULE_EXCLUDE, PG_RULE_HASH, PG_RULE_CHANNEL, PG_RULE_DEBOUNCE:
+	default:
+		return fmt.Errorf("unknown column rule '%s' of %s", kind, table)
+	}
+	rule := &PgColumnRule{Kind: kind, Columns: make([]string, 0)}
+	for _, column := range strings.Split(columns, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			rule.Columns = append(rule.Columns, column)
+		}
+	}
+	if len(rule.Columns) == 0 {
+		return fmt.Errorf("column rule '%s' of %s has no columns", kind, table)
+	}
+	if kind != PG_RULE_DEBOUNCE {
+		for _, column := range rule.Columns {
+			if err := pgCheckIdentifier(column, false); err != nil {
+				return fmt.Errorf("column rule '%s' of %s: %s", kind, table, err.Error())
+			}
+		}
+	}
+	if kind == PG_RULE_CHANNEL && len(rule.Columns) != 1 {
+		return fmt.Errorf("table %s should have one channel", table)
+	}
+	if kind == PG_RULE_DEBOUNCE {
+		if len(rule.Columns) != 1 {
+			return fmt.Errorf("table %s should have one debounce window", table)
+		}
+		if ms, err := strconv.Atoi(rule.Columns[0]); err != nil || ms < 0 {
+			return fmt.Errorf("debounce window of %s should be milliseconds, got '%s'", table, rule.Columns[0])
+		}
+	}
+	pcr.AddTable(table)
+	pcr.rules[table] = append(pcr.rules[table], rule)
+	return nil
+}
+
+// Tables returns the tables to capture
+func (pcr *PgColumnRules) Tables() []string {
+	return pcr.tables
+}
+
+// Channels returns notification channels of all tables
+func (pcr *PgColumnRules) Channels() []string {
+	channels := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, table := range pcr.tables {
+		channel := "cluster"
+		for _, rule := range pcr.rules[table] {
+			if rule.Kind == PG_RULE_CHANNEL {
+				channel = rule.Columns[0]
+			}
+		}
+		if !seen[channel] {
+			seen[channel] = true
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Debounce returns debounce windows of the tables, which have it
+func (pcr *PgColumnRules) Debounce() map[string]time.Duration {
+	windows := make(map[string]time.Duration)
+	for _, table := range pcr.tables {
+		for _, rule := range pcr.rules[table] {
+			if rule.Kind == PG_RULE_DEBOUNCE {
+				ms, _ := strconv.Atoi(rule.Columns[0])
+				windows[table] = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return windows
+}
+
+// Apply rules of the table to the row data
+func (pcr *PgColumnRules) Apply(table string, data map[string]interface{}) map[string]interface{} {
+	for _, rule := range pcr.rules[table] {
+		switch rule.Kind {
+		case PG_RULE_INCLUDE:
+			filtered := make(map[string]interface{})
+			for _, column := range rule.Columns {
+				if value, ex := data[column]; ex {
+					filtered[column] = value
+				}
+			}
+			data = filtered
+		case PG_RULE_EXCLUDE:
+			for _, column := range rule.Columns {
+				delete(data, column)
+			}
+		case PG_RULE_HASH:
+			for _, column := range rule.Columns {
+				if value, ex := data[column]; ex && value != nil {
+					sum := sha256.Sum256([]byte(pgText(value)))
+					data[column] = hex.EncodeToString(sum[:])
+				}
+			}
+		}
+	}
+	return data
+}
+
+// TriggerSQL generates triggers of all tables, calling the function with the rules
+func (pcr *PgColumnRules) TriggerSQL(function string) string {
+	var sql strings.Builder
+	for _, table := range pcr.tables {
+		args := make([]string, 0)
+		for _, rule := range pcr.rules[table] {
+			if rule.Kind == PG_RULE_DEBOUNCE {
+				continue // Applied by the listener
+			}
+			args = append(args, "'"+strings.Replace(rule.String(), "'", "''", -1)+"'")
+		}
+		name := pq.QuoteIdentifier(strings.Replace(table, ".", "_", -1) + "_notify_event")
+		relation := pgQuoteTable(table)
+		fmt.Fprintf(&sql, "-- %s\n", table)
+		fmt.Fprintf(&sql, "DROP TRIGGER IF EXISTS %s ON %s;\n", name, relation)
+		fmt.Fprintf(&sql, "CREATE TRIGGER %s\nAFTER INSERT OR UPDATE OR DELETE ON %s\n", name, relation)
+		fmt.Fprintf(&sql, "    FOR EACH ROW EXECUTE PROCEDURE %s(%s);\n\n", pq.QuoteIdentifier(function), strings.Join(args, ", "))
+	}
+	return sql.String()
+}
+
+// Text of the value, as "data->>column" gives it from jsonb
+func pgText(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	var buff strings.Builder
+	pgJSONText(&buff, value)
+	return buff.String()
+}
+
+// Write the value as jsonb text output: keys ordered by length and then bytes, spaced separators
+func pgJSONText(buff *strings.Builder, value interface{}) {
+	switch obj := value.(type) {
+	case nil:
+		buff.WriteString("null")
+	case bool:
+		buff.WriteString(strconv.FormatBool(obj))
+	case json.Number:
+		buff.WriteString(obj.String())
+	case float64:
+		buff.WriteString(strconv.FormatFloat(obj, 'f', -1, 64))
+	case string:
+		pgJSONString(buff, obj)
+	case []interface{}:
+		buff.WriteString("[")
+		for idx, item := range obj {
+			if idx > 0 {
+				buff.WriteString(", ")
+			}
+			pgJSONText(buff, item)
+		}
+		buff.WriteString("]")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		buff.WriteString("{")
+		for idx, key := range keys {
+			if idx > 0 {
+				buff.WriteString(", ")
+			}
+			pgJSONString(buff, key)
+			buff.WriteString(": ")
+			pgJSONText(buff, obj[key])
+		}
+		buff.WriteString("}")
+	default:
+		fmt.Fprint(buff, obj)
+	}
+}
+
+// Write JSON string, escaped as PostgreSQL does
+func pgJSONString(buff *strings.Builder, text string) {
+	buff.WriteByte('"')
+	for _, char := range text {
+		switch char {
+		case '"':
+			buff.WriteString(`\"`)
+		case '\\':
+			buff.WriteString(`\\`)
+		case '\b':
+			buff.WriteString(`\b`)
+		case '\f':
+			buff.WriteString(`\f`)
+		case '\n':
+			buff.WriteString(`\n`)
+		case '\r':
+			buff.WriteString(`\r`)
+		case '\t':
+			buff.WriteString(`\t`)
+		default:
+			if char < 0x20 {
+				fmt.Fprintf(buff, `\u%04x`, char)
+			} else {
+				buff.WriteRune(char)
+			}
+		}
+	}
+	buff.WriteByte('"')
+}
@@ -0,0 +1,197 @@
+/*
+Bounded worker pool of the database event callbacks.
+
+Each worker has its own bounded queue. Events are queued to the worker by their
+key (source, table and the primary key of the row), so changes of the same row
+are processed in order, one after another, while changes of different rows are
+processed in parallel. When the queue is full, the listener waits until there
+is a room for the event: the database notifications are then buffered by the
+connection, instead of spawning more goroutines.
+
+A barrier holds new jobs back until the jobs, queued before it, are finished,
+so it is not starved by the jobs, which keep coming in the meantime.
+*/
+
+package ncdtransport
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// PgWorkerStats are the backpressure metrics of the pool
+type PgWorkerStats struct {
+	Workers    int
+	Capacity   int           // Queue capacity of each worker
+	Queued     int           // Jobs, waiting in the queues or running
+	MaxQueued  int           // Highest amount of the queued jobs so far
+	Submitted  uint64        // Jobs, submitted since start
+	Processed  uint64        // Jobs, finished since start
+	Blocked    uint64        // Submits, which waited for a full queue
+	BlockedFor time.Duration // Total time of waiting for full queues
+}
+
+type PgWorkerPool struct {
+	workers  int
+	capacity int
+	queues   []chan func()
+	stats    PgWorkerStats
+	mtx      sync.Mutex
+	idle     *sync.Cond
+	running  sync.WaitGroup
+	started  bool
+	barriers int // Barriers and stops, which hold new jobs back
+	sending  int // Submits, which are sending the job to the queue
+}
+
+func NewPgWorkerPool() *PgWorkerPool {
+	pwp := new(PgWorkerPool)
+	pwp.workers = 4
+	pwp.capacity = 1000
+	pwp.idle = sync.NewCond(&pwp.mtx)
+	return pwp
+}
+
+// SetWorkers sets the amount of workers. Takes effect only before the pool is started.
+func (pwp *PgWorkerPool) SetWorkers(workers int) *PgWorkerPool {
+	if workers > 0 {
+		pwp.workers = workers
+	}
+	return pwp
+}
+
+// SetQueue sets the queue capacity of each worker. Takes effect only before the pool is started.
+func (pwp *PgWorkerPool) SetQueue(capacity int) *PgWorkerPool {
+	if capacity > 0 {
+		pwp.capacity = capacity
+	}
+	return pwp
+}
+
+// Start the workers. Called on the first submit, if not started before.
+func (pwp *PgWorkerPool) Start() *PgWorkerPool {
+	pwp.mtx.Lock()
+	defer pwp.mtx.Unlock()
+	pwp.start()
+	return pwp
+}
+
+func (pwp *PgWorkerPool) start() {
+	if pwp.started {
+		return
+	}
+	pwp.started = true
+	pwp.queues = make([]chan func(), pwp.workers)
+	for idx := range pwp.queues {
+		pwp.queues[idx] = make(chan func(), pwp.capacity)
+		pwp.running.Add(1)
+		go pwp.work(pwp.queues[idx])
+	}
+}
+
+// Stop closes the queues and waits until the workers finish the queued jobs and exit.
+// The pool is started again on the next submit.
+func (pwp *PgWorkerPool) Stop() {
+	pwp.mtx.Lock()
+	pwp.barriers++
+	for pwp.sending > 0 {
+		pwp.idle.Wait()
+	}
+	queues := pwp.queues
+	pwp.queues = nil
+	pwp.started = false
+	pwp.barriers--
+	pwp.idle.Broadcast()
+	pwp.mtx.Unlock()
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	pwp.running.Wait()
+}
+
+// Stats returns the backpressure metrics
+func (pwp *PgWorkerPool) Stats() PgWorkerStats {
+	pwp.mtx.Lock()
+	defer pwp.mtx.Unlock()
+	stats := pwp.stats
+	stats.Workers = pwp.workers
+	stats.Capacity = pwp.capacity
+	return stats
+}
+
+// Submit the job to the worker of the key. Jobs of the same key are run in the order of submitting.
+// Blocks while the queue of the worker is full, or a barrier is running.
+func (pwp *PgWorkerPool) Submit(key string, job func()) {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	pwp.mtx.Lock()
+	for pwp.barriers > 0 {
+		pwp.idle.Wait()
+	}
+	pwp.start()
+	queue := pwp.queues[hash.Sum32()%uint32(len(pwp.queues))]
+	pwp.stats.Submitted++
+	pwp.stats.Queued++
+	if pwp.stats.Queued > pwp.stats.MaxQueued {
+		pwp.stats.MaxQueued = pwp.stats.Queued
+	}
+	pwp.sending++
+	pwp.mtx.Unlock()
+
+	var blocked time.Duration
+	select {
+	case queue <- job:
+	default:
+		start := time.Now()
+		queue <- job
+		blocked = time.Since(start)
+	}
+
+	pwp.mtx.Lock()
+	if blocked > 0 {
+		pwp.stats.Blocked++
+		pwp.stats.BlockedFor += blocked
+	}
+	if pwp.sending--; pwp.sending == 0 {
+		pwp.idle.Broadcast()
+	}
+	pwp.mtx.Unlock()
+}
+
+// Barrier waits until all the queued jobs are finished and runs the job.
+// Used for the jobs of several keys, which should keep the order of all of them.
+// Jobs, submitted in the meantime, are queued after the job is finished.
+func (pwp *PgWorkerPool) Barrier(job func()) {
+	pwp.mtx.Lock()
+	pwp.barriers++
+	for pwp.stats.Queued > 0 {
+		pwp.idle.Wait()
+	}
+	pwp.mtx.Unlock()
+
+	defer func() {
+		pwp.mtx.Lock()
+		pwp.barriers--
+		pwp.idle.Broadcast()
+		pwp.mtx.Unlock()
+	}()
+	job()
+}
+
+// Run the jobs of the queue
+func (pwp *PgWorkerPool) work(queue chan func()) {
+	defer pwp.running.Done()
+	for job := range queue {
+		job()
+		pwp.mtx.Lock()
+		pwp.stats.Processed++
+		pwp.stats.Queued--
+		if pwp.stats.Queued == 0 {
+			pwp.idle.Broadcast()
+		}
+		pwp.mtx.Unlock()
+	}
+}
@@ -0,0 +1,404 @@
+/*
+Per-topic sequence numbers with gap detection and retransmission.
+
+Leader stamps every outgoing message with its stream Id and a monotonically
+increasing sequence number per topic, and keeps a bounded retention log of the
+sent messages. Stream Id changes on every leader start, so followers do not
+confuse restarted counters with duplicates.
+
+Follower tracks the last sequence number per stream and topic. If a message
+comes with a gap, the follower requests the missing range from the leader over
+the request/reply subject of the stream, applies what it got and only then the
+message itself. Messages that already have been seen are dropped.
+
+When the leader restarts, the new stream is followed from its first message
+for all the topics, followed before. Leader also periodically announces the
+last sequence numbers of its stream, so the loss of the last messages is
+detected without waiting for the next one.
+
+Announcements and retransmission replies are signed by the leader and accepted
+only from the leaders. A stream is followed, and the previous one is retired,
+only by a verified message of a leader: announcements of unknown streams are
+ignored.
+
+Each member of a queue group receives only a part of the messages, so the
+messages of queue subscriptions must not be checked by the sequencer.
+*/
+
+package ncdtransport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_STREAM   = "ncd-stream"
+	HEADER_SEQUENCE = "ncd-seq"
+)
+
+// Retransmission request of a sequence range
+type SeqRequest struct {
+	Topic string
+	From  int64
+	To    int64
+}
+
+// Announcement of the last sequence numbers of the leader stream
+type SeqAnnounce struct {
+	Stream    string
+	Last      map[string]int64
+	Signer    string `json:",omitempty"`
+	Time      time.Time
+	Signature string `json:",omitempty"`
+}
+
+// SeqGapFunc is called, when the announcement shows missing messages of the stream topic
+type SeqGapFunc func(stream string, topic string, from int64, to int64)
+
+// Retransmission reply. Messages are in wire form, as they were sent.
+type SeqReply struct {
+	Messages  [][]byte
+	First     int64  // First sequence number still available in the retention log
+	Signer    string `json:",omitempty"`
+	Time      time.Time
+	Signature string `json:",omitempty"`
+}
+
+// Retention log of one topic by the sequence numbers
+type seqLog struct {
+	first    int64
+	last     int64
+	messages map[int64][]byte
+}
+
+type Sequencer struct {
+	bus       Bus
+	signer    *MessageSigner
+	stream    string
+	counters  map[string]int64
+	retention map[string]*seqLog
+	maxlog    int
+	seen      map[string]map[string]int64 // stream to topic to last sequence
+	retired   map[string]bool             // streams of the previous leaders
+	timeout   time.Duration
+	announce  time.Duration
+	mtx       sync.Mutex
+}
+
+func NewSequencer(bus Bus) *Sequencer {
+	sq := new(Sequencer)
+	sq.bus = bus
+	sq.stream = uuid.New().String()
+	sq.counters = make(map[string]int64)
+	sq.retention = make(map[string]*seqLog)
+	sq.maxlog = 1000
+	sq.seen = make(map[string]map[string]int64)
+	sq.retired = make(map[string]bool)
+	sq.timeout = 5 * time.Second
+	sq.announce = 10 * time.Second
+	return sq
+}
+
+// SetRetention sets how many sent messages per topic are kept for retransmission
+func (sq *Sequencer) SetRetention(size int) *Sequencer {
+	if size > 0 {
+		sq.maxlog = size
+	}
+	return sq
+}
+
+// SetTimeout sets how long to wait for the leader to reply on retransmission request
+func (sq *Sequencer) SetTimeout(timeout time.Duration) *Sequencer {
+	sq.timeout = timeout
+	return sq
+}
+
+// SetAnnounceInterval sets how often the leader announces the last sequence numbers. Default is 10 seconds.
+func (sq *Sequencer) SetAnnounceInterval(interval time.Duration) *Sequencer {
+	if interval > 0 {
+		sq.announce = interval
+	}
+	return sq
+}
+
+// SetSigner sets the MessageSigner, signing and verifying announcements and retransmission replies
+func (sq *Sequencer) SetSigner(signer *MessageSigner) *Sequencer {
+	sq.signer = signer
+	return sq
+}
+
+// Subject of the leader announcements
+func (sq *Sequencer) announceSubject() string {
+	return SUBJECT_PREFIX + ".seq.last"
+}
+
+// Subject, where the leader serves retransmission requests of its stream
+func (sq *Sequencer) streamSubject(stream string) string {
+	return SUBJECT_PREFIX + ".seq." + stream
+}
+
+// Serve subscribes the leader to the retransmission requests of its stream and starts announcements
+func (sq *Sequencer) Serve() error {
+	if sq.signer == nil || sq.signer.PublicKey() == "" {
+		return fmt.Errorf("node key is required to serve retransmissions")
+	}
+	if _, err := sq.bus.Subscribe(sq.streamSubject(sq.stream), sq.onRequest); err != nil {
+		return err
+	}
+	go sq.announcer()
+	return nil
+}
+
+// Follow subscribes the follower to the leader announcements. Gaps are reported to the callback.
+func (sq *Sequencer) Follow(onGap SeqGapFunc) error {
+	if sq.signer == nil {
+		return fmt.Errorf("signer is required to follow announcements")
+	}
+	_, err := sq.bus.Subscribe(sq.announceSubject(), func(m *BusMsg) {
+		announce := new(SeqAnnounce)
+		if err := json.Unmarshal(m.Data, announce); err != nil {
+			log.Println("Wrong sequence announcement:", err.Error())
+			return
+		}
+		if announce.Stream == sq.stream {
+			return // Own stream
+		}
+		if err := sq.signer.VerifyAnnounce(announce); err != nil {
+			log.Println("Sequence announcement rejected:", err.Error())
+			return
+		}
+		for topic, gap := range sq.onAnnounce(announce) {
+			onGap(announce.Stream, topic, gap[0], gap[1])
+		}
+	})
+	return err
+}
+
+// Periodically announce the last sequence numbers of the stream
+func (sq *Sequencer) announcer() {
+	for {
+		time.Sleep(sq.announce)
+		sq.mtx.Lock()
+		announce := &SeqAnnounce{Stream: sq.stream, Last: make(map[string]int64)}
+		for topic, seq := range sq.counters {
+			announce.Last[topic] = seq
+		}
+		sq.mtx.Unlock()
+		if len(announce.Last) == 0 {
+			continue
+		}
+
+		err := sq.signer.SignAnnounce(announce)
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(announce)
+		}
+		if err == nil {
+			err = sq.bus.Publish(sq.announceSubject(), data)
+		}
+		if err != nil {
+			log.Println("Cannot announce sequence numbers:", err.Error())
+		}
+	}
+}
+
+// Find gaps of the followed topics from the announcement. Streams, which are not followed yet, are ignored.
+func (sq *Sequencer) onAnnounce(announce *SeqAnnounce) map[string][2]int64 {
+	gaps := make(map[string][2]int64)
+
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	topics, ex := sq.seen[announce.Stream]
+	if !ex {
+		return gaps
+	}
+	for topic, last := range topics {
+		if seq, ex := announce.Last[topic]; ex && seq > last {
+			gaps[topic] = [2]int64{last + 1, seq}
+		}
+	}
+	return gaps
+}
+
+// Get the topics of the stream. Stream, replacing the followed one, is followed from its start
+// for all the known topics. Returns nil for the streams of the previous leaders. Requires lock.
+func (sq *Sequencer) follow(stream string) map[string]int64 {
+	if sq.retired[stream] {
+		return nil
+	}
+	topics, ex := sq.seen[stream]
+	if ex {
+		return topics
+	}
+
+	topics = make(map[string]int64)
+	for previous, known := range sq.seen {
+		for topic := range known {
+			topics[topic] = 0
+		}
+		sq.retired[previous] = true
+	}
+	sq.seen = map[string]map[string]int64{stream: topics}
+	return topics
+}
+
+// Stamp the message with the stream Id and the next sequence number of its topic
+func (sq *Sequencer) Stamp(msg *MqMessage) {
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	sq.counters[msg.Topic]++
+	msg.SetHeader(HEADER_STREAM, sq.stream)
+	msg.SetHeader(HEADER_SEQUENCE, strconv.FormatInt(sq.counters[msg.Topic], 10))
+}
+
+// Unstamp takes the sequence number back from the message, which could not be sent.
+// Only the last stamped message of the topic can be unstamped, so stamping and sending should be serialised.
+func (sq *Sequencer) Unstamp(msg *MqMessage) {
+	seq, err := strconv.ParseInt(msg.GetHeader(HEADER_SEQUENCE), 10, 64)
+	if err != nil || msg.GetHeader(HEADER_STREAM) != sq.stream {
+		return
+	}
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	if sq.counters[msg.Topic] == seq {
+		sq.counters[msg.Topic]--
+	}
+}
+
+// Retain the sent message in the wire form for retransmission
+func (sq *Sequencer) Retain(msg *MqMessage, data []byte) {
+	seq, err := strconv.ParseInt(msg.GetHeader(HEADER_SEQUENCE), 10, 64)
+	if err != nil {
+		return
+	}
+
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	rlog, ex := sq.retention[msg.Topic]
+	if !ex {
+		rlog = &seqLog{first: seq, last: seq, messages: make(map[int64][]byte)}
+		sq.retention[msg.Topic] = rlog
+	}
+	rlog.messages[seq] = data
+	if seq > rlog.last {
+		rlog.last = seq
+	}
+	for len(rlog.messages) > sq.maxlog {
+		delete(rlog.messages, rlog.first)
+		rlog.first++
+	}
+}
+
+// Serve the retransmission request from the retention log
+func (sq *Sequencer) onRequest(m *BusMsg) {
+	req := new(SeqRequest)
+	reply := &SeqReply{Messages: make([][]byte, 0)}
+	if err := json.Unmarshal(m.Data, req); err != nil {
+		log.Println("Wrong retransmission request:", err.Error())
+	} else {
+		sq.mtx.Lock()
+		if rlog, ex := sq.retention[req.Topic]; ex {
+			reply.First = rlog.first
+			from, to := req.From, req.To
+			if from < rlog.first {
+				from = rlog.first
+			}
+			if to > rlog.last {
+				to = rlog.last
+			}
+			for seq := from; seq <= to; seq++ {
+				if data, ex := rlog.messages[seq]; ex {
+					reply.Messages = append(reply.Messages, data)
+				}
+			}
+		}
+		sq.mtx.Unlock()
+		log.Printf("Retransmitting %d messages of '%s' [%d-%d]", len(reply.Messages), req.Topic, req.From, req.To)
+	}
+
+	err := sq.signer.SignReply(reply)
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(reply)
+	}
+	if err == nil && m.Reply != "" {
+		err = sq.bus.Publish(m.Reply, data)
+	}
+	if err != nil {
+		log.Println("Cannot reply on retransmission request:", err.Error())
+	}
+}
+
+// Check the sequence of the incoming verified message.
+// Returns false, if the message was already seen and should be dropped.
+// Otherwise returns the range of the missing messages before this one, if any (from > to means no gap).
+// Only messages of the leaders are sequenced.
+func (sq *Sequencer) Check(msg *MqMessage) (bool, int64, int64) {
+	stream := msg.GetHeader(HEADER_STREAM)
+	seq, err := strconv.ParseInt(msg.GetHeader(HEADER_SEQUENCE), 10, 64)
+	if stream == "" || err != nil || sq.signer == nil || !sq.signer.IsLeader(msg.GetHeader(HEADER_SIGNER)) {
+		return true, 1, 0 // Not sequenced
+	}
+
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	topics := sq.follow(stream)
+	if topics == nil {
+		return false, 1, 0 // Late message of a previous leader
+	}
+
+	last, ex := topics[msg.Topic]
+	if ex && seq <= last {
+		return false, 1, 0
+	}
+	if !ex {
+		// First message of the topic in this stream: nothing to compare
+		last = seq - 1
+	}
+	return true, last + 1, seq - 1
+}
+
+// Seen marks the message as applied
+func (sq *Sequencer) Seen(msg *MqMessage) {
+	stream := msg.GetHeader(HEADER_STREAM)
+	seq, err := strconv.ParseInt(msg.GetHeader(HEADER_SEQUENCE), 10, 64)
+	if stream == "" || err != nil {
+		return
+	}
+
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	if topics, ex := sq.seen[stream]; ex && topics[msg.Topic] < seq {
+		topics[msg.Topic] = seq
+	}
+}
+
+// Fetch requests missing messages of the stream topic from the leader. It blocks up to the timeout,
+// so it should not be called on the bus handler.
+func (sq *Sequencer) Fetch(stream string, topic string, from int64, to int64) ([][]byte, error) {
+	data, err := json.Marshal(&SeqRequest{Topic: topic, From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sq.bus.Request(sq.streamSubject(stream), data, sq.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("retransmission request of '%s' [%d-%d] failed: %s", topic, from, to, err.Error())
+	}
+	reply := new(SeqReply)
+	if err := json.Unmarshal(resp.Data, reply); err != nil {
+		return nil, err
+	}
+	if err := sq.signer.VerifyReply(reply); err != nil {
+		return nil, fmt.Errorf("retransmission reply of '%s' [%d-%d] rejected: %s", topic, from, to, err.Error())
+	}
+	if reply.First > from {
+		log.Printf("Messages of '%s' [%d-%d] are no longer retained by the leader and are lost", topic, from, reply.First-1)
+	}
+	return reply.Messages, nil
+}
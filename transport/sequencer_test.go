@@ -0,0 +1,139 @@
+package ncdtransport
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// Signer with a new key under the directory
+func loadTestSigner(t *testing.T, dir string, name string) *MessageSigner {
+	signer := NewMessageSigner(name)
+	if err := GenerateKey(filepath.Join(dir, name+".key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.LoadKey(filepath.Join(dir, name+".key")); err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func sequenced(t *testing.T, signer *MessageSigner, stream string, seq int64) *MqMessage {
+	msg := NewMqMessage()
+	msg.Topic = "/test/item"
+	msg.SetHeader(HEADER_STREAM, stream)
+	msg.SetHeader(HEADER_SEQUENCE, strconv.FormatInt(seq, 10))
+	if err := signer.Sign(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSequencerIgnoresForeignStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leader := loadTestSigner(t, dir, "leader")
+	other := loadTestSigner(t, dir, "other")
+	follower := loadTestSigner(t, dir, "follower")
+	for _, signer := range []*MessageSigner{leader, other} {
+		if err := follower.AddTrustedKey(signer.Name(), signer.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	follower.AddLeader(leader.Name())
+	sq := NewSequencer(NewMemBus(NewMemBroker())).SetSigner(follower)
+
+	msg := sequenced(t, leader, "first", 1)
+	if fresh, from, to := sq.Check(msg); !fresh || from <= to {
+		t.Fatalf("first message: fresh %v, gap [%d-%d]", fresh, from, to)
+	}
+	sq.Seen(msg)
+
+	// Unsigned announcement and the one of a node, which is not a leader, are rejected
+	fake := &SeqAnnounce{Stream: "fake", Last: map[string]int64{msg.Topic: 100}}
+	if err := follower.VerifyAnnounce(fake); err == nil {
+		t.Fatal("unsigned announcement is accepted")
+	}
+	if err := other.SignAnnounce(fake); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.VerifyAnnounce(fake); err == nil {
+		t.Fatal("announcement of a node, which is not a leader, is accepted")
+	}
+
+	// Announcement of an unknown stream does not retire the followed one
+	announce := &SeqAnnounce{Stream: "second", Last: map[string]int64{msg.Topic: 100}}
+	if err := leader.SignAnnounce(announce); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.VerifyAnnounce(announce); err != nil {
+		t.Fatal(err)
+	}
+	if gaps := sq.onAnnounce(announce); len(gaps) != 0 {
+		t.Fatalf("gaps %v of an unknown stream", gaps)
+	}
+	// Nor a message of another stream from a node, which is not a leader
+	if fresh, from, to := sq.Check(sequenced(t, other, "third", 5)); !fresh || from <= to {
+		t.Fatalf("message of a node, which is not a leader: fresh %v, gap [%d-%d]", fresh, from, to)
+	}
+
+	if fresh, from, to := sq.Check(sequenced(t, leader, "first", 2)); !fresh || from <= to {
+		t.Fatalf("next message of the followed stream: fresh %v, gap [%d-%d]", fresh, from, to)
+	}
+}
+
+func TestSequencerRetainsBySequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	leader := loadTestSigner(t, dir, "leader")
+	follower := loadTestSigner(t, dir, "follower")
+	if err := follower.AddTrustedKey(leader.Name(), leader.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	follower.AddLeader(leader.Name())
+
+	broker := NewMemBroker()
+	lbus, fbus := NewMemBus(broker), NewMemBus(broker)
+	for _, bus := range []*MemBus{lbus, fbus} {
+		if err := bus.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer bus.Disconnect()
+	}
+	lsq := NewSequencer(lbus).SetSigner(leader).SetRetention(3)
+	if err := lsq.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	fsq := NewSequencer(fbus).SetSigner(follower)
+
+	// Second message could not be sent: its number is taken back, retention keeps no hole
+	for idx := 1; idx <= 6; idx++ {
+		msg := NewMqMessage()
+		msg.Topic = "/test/item"
+		msg.Id = strconv.Itoa(idx)
+		lsq.Stamp(msg)
+		if idx == 2 {
+			lsq.Unstamp(msg)
+			continue
+		}
+		lsq.Retain(msg, []byte(msg.Id))
+	}
+
+	missing, err := fsq.Fetch(lsq.stream, "/test/item", 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 3 || string(missing[0]) != "4" || string(missing[2]) != "6" {
+		t.Fatalf("retransmitted %q, expected messages 4-6 as sequences 3-5", missing)
+	}
+}
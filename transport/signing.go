@@ -0,0 +1,522 @@
+/*
+Message signing between the nodes.
+
+Each node has its own Ed25519 key pair. Every outgoing MqMessage is signed
+by the sender and carries its name and signature in the headers. Receiving
+node verifies the signature against the list of trusted public keys, and
+accepts data-changing topics only from the nodes, authorised as leaders.
+
+Director commands, object transfer frames, sequence announcements and
+retransmission replies are signed the same way. Commands are accepted only from
+the signers, authorised as directors. Objects of the leader topics are offered
+only by the leaders, and only the leaders announce and retransmit sequences.
+
+Signed data older than the replay window, or already seen within it, is rejected.
+Node messages are checked for replays only as they arrive live: retransmitted
+and retried ones are not, as they are old by nature.
+
+Trusted keys file has one key per line, as "<node name> <base64 public key>".
+Empty lines and lines starting with "#" are ignored.
+*/
+
+package ncdtransport
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_SIGNER    = "ncd-signer"
+	HEADER_SIGNATURE = "ncd-signature"
+)
+
+type MessageSigner struct {
+	name      string
+	private   ed25519.PrivateKey
+	trusted   map[string]ed25519.PublicKey
+	leaders   map[string]bool
+	directors map[string]bool
+	topics    []string
+	verify    bool
+	window    time.Duration
+	replays   map[string]time.Time // Signatures seen within the window
+	pruned    time.Time
+	mtx       sync.RWMutex
+}
+
+func NewMessageSigner(name string) *MessageSigner {
+	ms := new(MessageSigner)
+	ms.name = name
+	ms.trusted = make(map[string]ed25519.PublicKey)
+	ms.leaders = make(map[string]bool)
+	ms.directors = make(map[string]bool)
+	ms.topics = make([]string, 0)
+	ms.verify = true
+	ms.window = 5 * time.Minute
+	ms.replays = make(map[string]time.Time)
+	ms.pruned = time.Now()
+	return ms
+}
+
+// Name of the node, which is sent along with the signature
+func (ms *MessageSigner) Name() string {
+	return ms.name
+}
+
+// GenerateKey writes a new private key of the node. Existing key file is not overwritten.
+func GenerateKey(fpath string) error {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	return createSecretFile("Node key", fpath, []byte(base64.StdEncoding.EncodeToString(private.Seed())+"\n"))
+}
+
+// LoadKey loads the private key of the node
+func (ms *MessageSigner) LoadKey(fpath string) error {
+	if err := checkSecretFile("Node key", fpath); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("node key %s is not a valid Ed25519 seed", fpath)
+	}
+	ms.private = ed25519.NewKeyFromSeed(seed)
+
+	return nil
+}
+
+// PublicKey returns base64-encoded public key of the node
+func (ms *MessageSigner) PublicKey() string {
+	if ms.private == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(ms.private.Public().(ed25519.PublicKey))
+}
+
+// LoadTrustedKeys loads the file with the trusted public keys of the nodes
+func (ms *MessageSigner) LoadTrustedKeys(fpath string) error {
+	fh, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"<node name> <public key>\"", fpath, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("%s:%d: public key of %s is not a valid Ed25519 key", fpath, line, fields[0])
+		}
+		ms.trusted[fields[0]] = ed25519.PublicKey(key)
+	}
+
+	return scanner.Err()
+}
+
+// AddTrustedKey adds a base64-encoded public key of the node
+func (ms *MessageSigner) AddTrustedKey(name string, pubkey string) error {
+	key, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key of %s is not a valid Ed25519 key", name)
+	}
+	ms.mtx.Lock()
+	ms.trusted[name] = ed25519.PublicKey(key)
+	ms.mtx.Unlock()
+	return nil
+}
+
+// AddLeader authorises the node to send data-changing messages
+func (ms *MessageSigner) AddLeader(name string) *MessageSigner {
+	ms.mtx.Lock()
+	ms.leaders[name] = true
+	ms.mtx.Unlock()
+	return ms
+}
+
+// AddDirector authorises the node or tool to send director commands
+func (ms *MessageSigner) AddDirector(name string) *MessageSigner {
+	ms.mtx.Lock()
+	ms.directors[name] = true
+	ms.mtx.Unlock()
+	return ms
+}
+
+// IsLeader returns true, if the node is authorised as a leader. Always true, if verification is off.
+func (ms *MessageSigner) IsLeader(name string) bool {
+	if !ms.verify {
+		return true
+	}
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	return ms.leaders[name]
+}
+
+// SetReplayWindow sets how old signed data can be, and for how long it is remembered against replays.
+// Default is 5 minutes. Clocks of the nodes should not differ more than that.
+func (ms *MessageSigner) SetReplayWindow(window time.Duration) *MessageSigner {
+	if window > 0 {
+		ms.window = window
+	}
+	return ms
+}
+
+// AddLeaderTopic adds a topic prefix, which is accepted only from the leader nodes, e.g. "/uyuni"
+func (ms *MessageSigner) AddLeaderTopic(prefix string) *MessageSigner {
+	ms.topics = append(ms.topics, prefix)
+	return ms
+}
+
+// SetVerify turns ON or OFF verification of incoming messages. Do not turn it off in production.
+func (ms *MessageSigner) SetVerify(verify bool) *MessageSigner {
+	ms.verify = verify
+	return ms
+}
+
+// Sign the message
+func (ms *MessageSigner) Sign(msg *MqMessage) error {
+	if ms.private == nil {
+		return errors.New("node key is not loaded")
+	}
+	data, err := ms.canonical(msg)
+	if err != nil {
+		return err
+	}
+	msg.SetHeader(HEADER_SIGNER, ms.name)
+	msg.SetHeader(HEADER_SIGNATURE, base64.StdEncoding.EncodeToString(ed25519.Sign(ms.private, data)))
+
+	return nil
+}
+
+// Verify the message signature and whether the signer is allowed to send the topic
+func (ms *MessageSigner) Verify(msg *MqMessage) error {
+	if !ms.verify {
+		return nil
+	}
+
+	signer := msg.GetHeader(HEADER_SIGNER)
+	if signer == "" {
+		return fmt.Errorf("message %s is not signed", msg.Id)
+	}
+	signature, err := base64.StdEncoding.DecodeString(msg.GetHeader(HEADER_SIGNATURE))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("message %s has malformed signature", msg.Id)
+	}
+
+	ms.mtx.RLock()
+	key, trusted := ms.trusted[signer]
+	leader := ms.leaders[signer]
+	ms.mtx.RUnlock()
+
+	if !trusted {
+		return fmt.Errorf("message %s is signed by untrusted node '%s'", msg.Id, signer)
+	}
+	data, err := ms.canonical(msg)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("message %s has wrong signature of '%s'", msg.Id, signer)
+	}
+	if !leader && ms.isLeaderTopic(msg.Topic) {
+		return fmt.Errorf("node '%s' is not authorised to send topic '%s'", signer, msg.Topic)
+	}
+
+	return nil
+}
+
+// CheckReplay rejects the verified message, if it is older than the replay window or has been already seen
+func (ms *MessageSigner) CheckReplay(msg *MqMessage) error {
+	if !ms.verify {
+		return nil
+	}
+	if err := ms.checkReplay(msg.GetHeader(HEADER_SIGNATURE), msg.Timestamp); err != nil {
+		return fmt.Errorf("message %s: %s", msg.Id, err.Error())
+	}
+	return nil
+}
+
+// Returns true, if the topic is accepted only from the leaders
+func (ms *MessageSigner) isLeaderTopic(topic string) bool {
+	for _, prefix := range ms.topics {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the signature of the trusted signer over the data
+func (ms *MessageSigner) checkSignature(signer string, signature string, data []byte) error {
+	if signer == "" {
+		return errors.New("not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("malformed signature")
+	}
+
+	ms.mtx.RLock()
+	key, trusted := ms.trusted[signer]
+	ms.mtx.RUnlock()
+
+	if !trusted {
+		return fmt.Errorf("signed by untrusted '%s'", signer)
+	}
+	if !ed25519.Verify(key, data, sig) {
+		return fmt.Errorf("wrong signature of '%s'", signer)
+	}
+	return nil
+}
+
+// SignCommand signs the director command with the current time
+func (ms *MessageSigner) SignCommand(cmd *CdtCommand) error {
+	if ms.private == nil {
+		return errors.New("node key is not loaded")
+	}
+	cmd.Signer = ms.name
+	cmd.Time = time.Now().UTC()
+	data, err := ms.canonicalCommand(cmd)
+	if err != nil {
+		return err
+	}
+	cmd.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(ms.private, data))
+	return nil
+}
+
+// VerifyCommand verifies the command signature, whether the signer is a director, and that it is not a replay
+func (ms *MessageSigner) VerifyCommand(cmd *CdtCommand) error {
+	if !ms.verify {
+		return nil
+	}
+	data, err := ms.canonicalCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if err := ms.checkSignature(cmd.Signer, cmd.Signature, data); err != nil {
+		return fmt.Errorf("command '%s': %s", cmd.Command, err.Error())
+	}
+
+	ms.mtx.RLock()
+	director := ms.directors[cmd.Signer]
+	ms.mtx.RUnlock()
+
+	if !director {
+		return fmt.Errorf("'%s' is not authorised to send director commands", cmd.Signer)
+	}
+	if err := ms.checkReplay(cmd.Signature, cmd.Time); err != nil {
+		return fmt.Errorf("command '%s': %s", cmd.Command, err.Error())
+	}
+	return nil
+}
+
+// SignFrame signs the object transfer frame with the current time
+func (ms *MessageSigner) SignFrame(frame *ObjectFrame) error {
+	if ms.private == nil {
+		return errors.New("node key is not loaded")
+	}
+	frame.Signer = ms.name
+	frame.Time = time.Now().UTC()
+	frame.Signature = ""
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	frame.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(ms.private, data))
+	return nil
+}
+
+// VerifyFrame verifies the frame signature, whether the signer may offer the object topic, and that it is not a replay.
+// Topic is known only from the offer, so chunks should be checked to be of the same signer.
+func (ms *MessageSigner) VerifyFrame(frame *ObjectFrame) error {
+	if !ms.verify {
+		return nil
+	}
+	unsigned := *frame
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return err
+	}
+	if err := ms.checkSignature(frame.Signer, frame.Signature, data); err != nil {
+		return fmt.Errorf("%s frame of object %s: %s", frame.Kind, frame.Id, err.Error())
+	}
+
+	ms.mtx.RLock()
+	leader := ms.leaders[frame.Signer]
+	ms.mtx.RUnlock()
+
+	if frame.Info != nil && !leader && ms.isLeaderTopic(frame.Info.Topic) {
+		return fmt.Errorf("node '%s' is not authorised to send objects of topic '%s'", frame.Signer, frame.Info.Topic)
+	}
+	if err := ms.checkReplay(frame.Signature, frame.Time); err != nil {
+		return fmt.Errorf("%s frame of object %s: %s", frame.Kind, frame.Id, err.Error())
+	}
+	return nil
+}
+
+// SignAnnounce signs the sequence announcement of the leader with the current time
+func (ms *MessageSigner) SignAnnounce(announce *SeqAnnounce) error {
+	if ms.private == nil {
+		return errors.New("node key is not loaded")
+	}
+	announce.Signer = ms.name
+	announce.Time = time.Now().UTC()
+	announce.Signature = ""
+	data, err := json.Marshal(announce)
+	if err != nil {
+		return err
+	}
+	announce.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(ms.private, data))
+	return nil
+}
+
+// VerifyAnnounce verifies the announcement signature, whether the signer is a leader, and that it is not a replay
+func (ms *MessageSigner) VerifyAnnounce(announce *SeqAnnounce) error {
+	if !ms.verify {
+		return nil
+	}
+	unsigned := *announce
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return err
+	}
+	if err := ms.checkLeader(announce.Signer, announce.Signature, announce.Time, data); err != nil {
+		return fmt.Errorf("announcement of stream %s: %s", announce.Stream, err.Error())
+	}
+	return nil
+}
+
+// SignReply signs the retransmission reply of the leader with the current time
+func (ms *MessageSigner) SignReply(reply *SeqReply) error {
+	if ms.private == nil {
+		return errors.New("node key is not loaded")
+	}
+	reply.Signer = ms.name
+	reply.Time = time.Now().UTC()
+	reply.Signature = ""
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	reply.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(ms.private, data))
+	return nil
+}
+
+// VerifyReply verifies the retransmission reply signature, whether the signer is a leader, and that it is not a replay
+func (ms *MessageSigner) VerifyReply(reply *SeqReply) error {
+	if !ms.verify {
+		return nil
+	}
+	unsigned := *reply
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return err
+	}
+	return ms.checkLeader(reply.Signer, reply.Signature, reply.Time, data)
+}
+
+// Check the signature of the leader over the data, and that it is not a replay
+func (ms *MessageSigner) checkLeader(signer string, signature string, signed time.Time, data []byte) error {
+	if err := ms.checkSignature(signer, signature, data); err != nil {
+		return err
+	}
+	if !ms.IsLeader(signer) {
+		return fmt.Errorf("'%s' is not a leader", signer)
+	}
+	return ms.checkReplay(signature, signed)
+}
+
+// Reject signed data out of the replay window or already seen within it
+func (ms *MessageSigner) checkReplay(signature string, signed time.Time) error {
+	if age := time.Since(signed); age > ms.window || age < -ms.window {
+		return fmt.Errorf("signed at %s, which is out of the replay window", signed.Format(time.RFC3339))
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if time.Since(ms.pruned) > ms.window {
+		for seen, at := range ms.replays {
+			if time.Since(at) > 2*ms.window {
+				delete(ms.replays, seen)
+			}
+		}
+		ms.pruned = time.Now()
+	}
+	if _, ex := ms.replays[signature]; ex {
+		return errors.New("replayed signature")
+	}
+	ms.replays[signature] = time.Now()
+	return nil
+}
+
+// Canonical form of the director command without the signature
+func (ms *MessageSigner) canonicalCommand(cmd *CdtCommand) ([]byte, error) {
+	unsigned := *cmd
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
+}
+
+// Canonical form of the message without the signature, independent from the wire codec.
+// Message is normalised through the generic JSON values, so the same message
+// results to the same bytes on both sides.
+func (ms *MessageSigner) canonical(msg *MqMessage) ([]byte, error) {
+	headers := make(map[string]string)
+	for name, value := range msg.Headers {
+		if name != HEADER_SIGNATURE {
+			headers[name] = value
+		}
+	}
+	headers[HEADER_SIGNER] = msg.GetHeader(HEADER_SIGNER)
+	if headers[HEADER_SIGNER] == "" {
+		headers[HEADER_SIGNER] = ms.name
+	}
+
+	unsigned := *msg
+	unsigned.Headers = headers
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
+}
@@ -0,0 +1,60 @@
+/*
+Message topics are mapped onto hierarchical NATS subjects, so the nodes
+subscribe only to the domains they replicate, and NATS does the filtering.
+
+Topic "/uyuni/rhnchannel" on the "nodes" channel becomes subject
+"ncd.nodes.uyuni.rhnchannel". Topic patterns may use NATS wildcards
+as path elements: "/uyuni/*" matches one level, "/uyuni/>" matches
+everything below "/uyuni".
+*/
+
+package ncdtransport
+
+import (
+	"strings"
+)
+
+const SUBJECT_PREFIX = "ncd"
+
+// Make a valid NATS subject token from a topic path element
+func subjectToken(element string) string {
+	if element == "*" || element == ">" {
+		return element
+	}
+	return strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_", "\t", "_").Replace(element)
+}
+
+// TopicToSubject maps a topic (or topic pattern) on the channel onto a NATS subject
+func TopicToSubject(channel string, topic string) string {
+	tokens := []string{SUBJECT_PREFIX, channel}
+	for _, element := range strings.Split(topic, "/") {
+		if element != "" {
+			tokens = append(tokens, subjectToken(element))
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// Subscription of the channel topics, optionally in a queue group.
+// Only one member of a queue group receives a message.
+type TopicSubscription struct {
+	Pattern string
+	Queue   string
+}
+
+// ParseTopicSubscriptions parses comma-separated "<topic pattern>[@<queue group>]" list
+func ParseTopicSubscriptions(spec string) []*TopicSubscription {
+	subs := make([]*TopicSubscription, 0)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sub := &TopicSubscription{Pattern: item}
+		if idx := strings.LastIndex(item, "@"); idx > -1 {
+			sub.Pattern, sub.Queue = strings.TrimSpace(item[:idx]), strings.TrimSpace(item[idx+1:])
+		}
+		subs = append(subs, sub)
+	}
+	return subs
+}
@@ -1,17 +1,94 @@
 package ncdtransport
 
 import (
-	"github.com/nats-io/nats.go"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 )
 
+// BusMsg is a message, received from the bus
+type BusMsg struct {
+	Subject string
+	Reply   string
+	Data    []byte
+}
+
+// BusHandler is called on every message of the subscription
+type BusHandler func(m *BusMsg)
+
+// BusSubscription is an active subscription on the bus
+type BusSubscription interface {
+	Unsubscribe() error
+}
+
+// Bus is a message bus, ncd is running on.
+// Subjects are dot-separated tokens, where "*" matches one token
+// and ">" matches all the rest tokens, as in NATS.
+type Bus interface {
+	// Start connects to the bus
+	Start() error
+
+	// Publish data to the subject
+	Publish(subject string, data []byte) error
+
+	// Subscribe to the subject
+	Subscribe(subject string, handler BusHandler) (BusSubscription, error)
+
+	// QueueSubscribe subscribes to the subject in a queue group. Only one member of the group receives a message.
+	QueueSubscribe(subject string, queue string, handler BusHandler) (BusSubscription, error)
+
+	// Request publishes data and waits for a single reply
+	Request(subject string, data []byte, timeout time.Duration) (*BusMsg, error)
+
+	// State of the connection
+	State() BusState
+
+	// Drain processes pending messages and then unsubscribes everything
+	Drain() error
+
+	// Disconnect from the bus
+	Disconnect()
+}
+
 // Subscriber interface
 type Subscriber interface {
-	OnReceive(body *nats.Msg)
+	OnReceive(m *BusMsg)
 	Topic() string
 }
 
 // Publisher interface
 type Publisher interface {
-	SetPublisher(nc *nats.Conn)
+	SetBus(bus Bus)
 	Topic() string
 }
+
+// Write a new secret file, readable only by the owner. Existing file is never overwritten.
+func createSecretFile(kind string, fpath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(fpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s file %s already exists", kind, fpath)
+	} else if err != nil {
+		return err
+	}
+	_, err = fh.Write(data)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Check that a secret file exists and is not accessible by group or others
+func checkSecretFile(kind string, fpath string) error {
+	stat, err := os.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	if stat.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s file %s is accessible by group or others (mode %o), should be 0600", kind, fpath, stat.Mode().Perm())
+	}
+	return nil
+}
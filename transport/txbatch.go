@@ -0,0 +1,130 @@
+/*
+Transaction-grouped messages.
+
+Changes made in one database transaction are sent as separate messages, but
+stamped with the same transaction Id, their index and the size of the group.
+Followers collect the group and apply it at once, in order. Followers, which
+are not subscribed to all topics of the group, would never see all of it:
+incomplete group is applied with what arrived after the timeout.
+*/
+
+package ncdtransport
+
+import (
+	"github.com/google/uuid"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_TX       = "ncd-tx"
+	HEADER_TX_INDEX = "ncd-tx-index"
+	HEADER_TX_SIZE  = "ncd-tx-size"
+)
+
+// StampTx marks the messages as one transaction. Single message is not a group.
+func StampTx(msgs []*MqMessage) {
+	if len(msgs) < 2 {
+		return
+	}
+	id := uuid.New().String()
+	for idx, msg := range msgs {
+		msg.SetHeader(HEADER_TX, id)
+		msg.SetHeader(HEADER_TX_INDEX, strconv.Itoa(idx))
+		msg.SetHeader(HEADER_TX_SIZE, strconv.Itoa(len(msgs)))
+	}
+}
+
+// TxEntry is a received message of a transaction with its wire data
+type TxEntry struct {
+	Msg  *MqMessage
+	Data []byte
+}
+
+// TxCallback is called with the messages of a transaction, in order
+type TxCallback func(entries []*TxEntry)
+
+type txGroup struct {
+	entries map[int]*TxEntry
+	size    int
+	timer   *time.Timer
+}
+
+type TxAssembler struct {
+	groups   map[string]*txGroup
+	timeout  time.Duration
+	callback TxCallback
+	mtx      sync.Mutex
+}
+
+func NewTxAssembler(callback TxCallback) *TxAssembler {
+	ta := new(TxAssembler)
+	ta.groups = make(map[string]*txGroup)
+	ta.timeout = 5 * time.Second
+	ta.callback = callback
+	return ta
+}
+
+// SetTimeout sets how long an incomplete transaction is waited for
+func (ta *TxAssembler) SetTimeout(timeout time.Duration) *TxAssembler {
+	ta.timeout = timeout
+	return ta
+}
+
+// Add the message to its transaction. Returns false, if the message is not a part of any.
+// The callback is called, once the transaction is complete.
+func (ta *TxAssembler) Add(msg *MqMessage, data []byte) bool {
+	id := msg.GetHeader(HEADER_TX)
+	idx, ierr := strconv.Atoi(msg.GetHeader(HEADER_TX_INDEX))
+	size, serr := strconv.Atoi(msg.GetHeader(HEADER_TX_SIZE))
+	if id == "" || ierr != nil || serr != nil || size < 2 || idx < 0 || idx >= size {
+		return false
+	}
+
+	ta.mtx.Lock()
+	group, ex := ta.groups[id]
+	if !ex {
+		group = &txGroup{entries: make(map[int]*TxEntry), size: size}
+		group.timer = time.AfterFunc(ta.timeout, func() { ta.flush(id, true) })
+		ta.groups[id] = group
+	}
+	group.entries[idx] = &TxEntry{Msg: msg, Data: data}
+	complete := len(group.entries) == group.size
+	ta.mtx.Unlock()
+
+	if complete {
+		ta.flush(id, false)
+	}
+	return true
+}
+
+// Pass the transaction to the callback
+func (ta *TxAssembler) flush(id string, timeout bool) {
+	ta.mtx.Lock()
+	group, ex := ta.groups[id]
+	if ex {
+		delete(ta.groups, id)
+		group.timer.Stop()
+	}
+	ta.mtx.Unlock()
+	if !ex {
+		return
+	}
+
+	if timeout {
+		log.Printf("Transaction %s is incomplete (%d of %d messages), applying what arrived", id, len(group.entries), group.size)
+	}
+	indexes := make([]int, 0, len(group.entries))
+	for idx := range group.entries {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	entries := make([]*TxEntry, len(indexes))
+	for pos, idx := range indexes {
+		entries[pos] = group.entries[idx]
+	}
+	ta.callback(entries)
+}
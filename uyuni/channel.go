@@ -0,0 +1,87 @@
+package uyuni
+
+import (
+	"context"
+)
+
+// Channel details, as in "channel.software.getDetails".
+// JSON names are the same, so the details are sent to the nodes as is.
+type Channel struct {
+	Id                 int    `xmlrpc:"id" json:"id"`
+	Label              string `xmlrpc:"label" json:"label"`
+	Name               string `xmlrpc:"name" json:"name"`
+	Summary            string `xmlrpc:"summary" json:"summary"`
+	Description        string `xmlrpc:"description" json:"description"`
+	ArchName           string `xmlrpc:"arch_name" json:"arch_name"`
+	ArchLabel          string `xmlrpc:"arch_label" json:"arch_label"`
+	ParentChannelLabel string `xmlrpc:"parent_channel_label" json:"parent_channel_label"`
+	ChecksumLabel      string `xmlrpc:"checksum_label" json:"checksum_label"`
+	GPGKeyURL          string `xmlrpc:"gpg_key_url" json:"gpg_key_url"`
+	GPGKeyId           string `xmlrpc:"gpg_key_id" json:"gpg_key_id"`
+	GPGKeyFP           string `xmlrpc:"gpg_key_fp" json:"gpg_key_fp"`
+	GPGCheck           bool   `xmlrpc:"gpg_check" json:"gpg_check"`
+	MaintainerName     string `xmlrpc:"maintainer_name" json:"maintainer_name"`
+	MaintainerEmail    string `xmlrpc:"maintainer_email" json:"maintainer_email"`
+	MaintainerPhone    string `xmlrpc:"maintainer_phone" json:"maintainer_phone"`
+	SupportPolicy      string `xmlrpc:"support_policy" json:"support_policy"`
+}
+
+// ChannelSummary is a channel, as in "channel.listAllChannels"
+type ChannelSummary struct {
+	Id       int    `xmlrpc:"id" json:"id"`
+	Label    string `xmlrpc:"label" json:"label"`
+	Name     string `xmlrpc:"name" json:"name"`
+	ArchName string `xmlrpc:"arch_name" json:"arch_name"`
+	Packages int    `xmlrpc:"packages" json:"packages"`
+	Systems  int    `xmlrpc:"systems" json:"systems"`
+}
+
+// Repo is a content source, as in "channel.software.getRepoDetails"
+type Repo struct {
+	Id        int    `xmlrpc:"id" json:"id"`
+	Label     string `xmlrpc:"label" json:"label"`
+	SourceURL string `xmlrpc:"sourceUrl" json:"sourceUrl"`
+	Type      string `xmlrpc:"type" json:"type"`
+}
+
+// ListAllChannels returns all channels, visible to the user
+func (c *Client) ListAllChannels(ctx context.Context) ([]ChannelSummary, error) {
+	channels := make([]ChannelSummary, 0)
+	return channels, c.SessionCall(ctx, "channel.listAllChannels", &channels)
+}
+
+// GetChannelDetails returns the channel by its label
+func (c *Client) GetChannelDetails(ctx context.Context, label string) (*Channel, error) {
+	channel := new(Channel)
+	if err := c.SessionCall(ctx, "channel.software.getDetails", channel, label); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// CreateChannel creates a software channel from the details
+func (c *Client) CreateChannel(ctx context.Context, channel *Channel) error {
+	gpgkey := map[string]interface{}{
+		"url":         channel.GPGKeyURL,
+		"id":          channel.GPGKeyId,
+		"fingerprint": channel.GPGKeyFP,
+	}
+	var result int
+	return c.SessionCall(ctx, "channel.software.create", &result, channel.Label, channel.Name, channel.Summary,
+		channel.ArchLabel, channel.ParentChannelLabel, channel.ChecksumLabel, gpgkey, channel.GPGCheck)
+}
+
+// DeleteChannel deletes the channel by its label
+func (c *Client) DeleteChannel(ctx context.Context, label string) error {
+	var result int
+	return c.SessionCall(ctx, "channel.software.delete", &result, label)
+}
+
+// GetRepoDetails returns the repository by its label
+func (c *Client) GetRepoDetails(ctx context.Context, label string) (*Repo, error) {
+	repo := new(Repo)
+	if err := c.SessionCall(ctx, "channel.software.getRepoDetails", repo, label); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
@@ -0,0 +1,231 @@
+/*
+Uyuni Server XML-RPC API client.
+
+Every call takes a context and is limited by the client timeout, unless the
+context has an earlier deadline. Session is opened on the first call, and is
+opened again once, if the server says it is expired. Server faults are returned
+as *Fault, so the callers can tell a missing entity from a broken connection.
+*/
+
+package uyuni
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/kolo/xmlrpc"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Client struct {
+	url      string
+	user     string
+	password string
+	verify   bool
+	timeout  time.Duration
+	http     *http.Client
+	session  string
+	login    *clientLogin // Login in progress, shared by the concurrent callers
+	mtx      sync.Mutex
+}
+
+type clientLogin struct {
+	done    chan struct{}
+	session string
+	err     error
+}
+
+func NewClient(url string) *Client {
+	c := new(Client)
+	c.url = url
+	c.verify = true
+	c.timeout = 30 * time.Second
+	c.http = c.newHTTP()
+	return c
+}
+
+// SetURL sets the URL of the API endpoint, e.g. "https://uyuni.example.com/rpc/api"
+func (c *Client) SetURL(url string) *Client {
+	c.mtx.Lock()
+	c.url = url
+	c.session = ""
+	c.mtx.Unlock()
+	return c
+}
+
+// SetUser sets the API user and password
+func (c *Client) SetUser(user string, password string) *Client {
+	c.mtx.Lock()
+	c.user = user
+	c.password = password
+	c.session = ""
+	c.mtx.Unlock()
+	return c
+}
+
+// SetTLSVerify turns on or off verification of the server certificate. Default is on.
+func (c *Client) SetTLSVerify(verify bool) *Client {
+	c.mtx.Lock()
+	c.verify = verify
+	c.http = c.newHTTP()
+	c.mtx.Unlock()
+	return c
+}
+
+// SetTimeout sets the timeout of each call. Default is 30 seconds.
+func (c *Client) SetTimeout(timeout time.Duration) *Client {
+	if timeout > 0 {
+		c.mtx.Lock()
+		c.timeout = timeout
+		c.mtx.Unlock()
+	}
+	return c
+}
+
+// Create HTTP client with the current TLS verification
+func (c *Client) newHTTP() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: !c.verify},
+	}}
+}
+
+// Get URL, timeout and HTTP client of the call
+func (c *Client) settings() (string, time.Duration, *http.Client) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.url, c.timeout, c.http
+}
+
+// Call the API function without a session and unmarshal the result into the reply, if any
+func (c *Client) Call(ctx context.Context, method string, reply interface{}, args ...interface{}) error {
+	url, timeout, client := c.settings()
+	if url == "" {
+		return errors.New("Uyuni API URL is not set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := xmlrpc.NewRequest(url, method, args)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%s: HTTP status %d", method, response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+
+	result := xmlrpc.Response(body)
+	if err := result.Err(); err != nil {
+		var fault xmlrpc.FaultError
+		if errors.As(err, &fault) {
+			return &Fault{Method: method, Code: fault.Code, Message: fault.String}
+		}
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	if reply == nil {
+		return nil
+	}
+	if err := result.Unmarshal(reply); err != nil {
+		return fmt.Errorf("%s: wrong result: %w", method, err)
+	}
+	return nil
+}
+
+// SessionCall calls the API function with the session key as the first argument.
+// Expired session is renewed and the call is repeated once.
+func (c *Client) SessionCall(ctx context.Context, method string, reply interface{}, args ...interface{}) error {
+	session, err := c.getSession(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.Call(ctx, method, reply, append([]interface{}{session}, args...)...)
+	if !IsSessionExpired(err) {
+		return err
+	}
+
+	log.Println("Uyuni API session has expired, logging in again")
+	c.mtx.Lock()
+	if c.session == session {
+		c.session = ""
+	}
+	c.mtx.Unlock()
+	if session, err = c.getSession(ctx); err != nil {
+		return err
+	}
+	return c.Call(ctx, method, reply, append([]interface{}{session}, args...)...)
+}
+
+// Get current session, logging in if there is none.
+// Login is done without holding the lock, concurrent callers wait for its result.
+func (c *Client) getSession(ctx context.Context) (string, error) {
+	c.mtx.Lock()
+	if c.session != "" {
+		session := c.session
+		c.mtx.Unlock()
+		return session, nil
+	}
+	if c.user == "" {
+		c.mtx.Unlock()
+		return "", errors.New("Uyuni API user is not set")
+	}
+	login := c.login
+	if login != nil {
+		c.mtx.Unlock()
+		select {
+		case <-login.done:
+			return login.session, login.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	login = &clientLogin{done: make(chan struct{})}
+	c.login = login
+	user, password := c.user, c.password
+	c.mtx.Unlock()
+
+	login.err = c.Call(ctx, "auth.login", &login.session, user, password)
+
+	c.mtx.Lock()
+	if login.err == nil {
+		c.session = login.session
+	}
+	c.login = nil
+	c.mtx.Unlock()
+	close(login.done)
+
+	return login.session, login.err
+}
+
+// Login opens a new session
+func (c *Client) Login(ctx context.Context) error {
+	c.mtx.Lock()
+	c.session = ""
+	c.mtx.Unlock()
+	_, err := c.getSession(ctx)
+	return err
+}
+
+// Logout closes the session, if any
+func (c *Client) Logout(ctx context.Context) error {
+	c.mtx.Lock()
+	session := c.session
+	c.session = ""
+	c.mtx.Unlock()
+	if session == "" {
+		return nil
+	}
+	return c.Call(ctx, "auth.logout", nil, session)
+}
@@ -0,0 +1,102 @@
+package uyuni
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+var (
+	methodName = regexp.MustCompile(`<methodName>([^<]+)</methodName>`)
+	firstParam = regexp.MustCompile(`<param>\s*<value>\s*(?:<string>)?([^<]*)`)
+)
+
+// Fake API server, which gives a new session on every login and expires the first one
+type fakeServer struct {
+	logins int
+	mtx    sync.Mutex
+}
+
+func (fs *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	method := methodName.FindSubmatch(body)
+	param := firstParam.FindSubmatch(body)
+	if method == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	switch {
+	case string(method[1]) == "auth.login":
+		fs.logins++
+		writeValue(w, fmt.Sprintf("<string>session-%d</string>", fs.logins))
+	case param == nil || string(param[1]) == "session-1":
+		writeFault(w, 2950, "Could not find session with key session-1")
+	case string(method[1]) == "channel.software.getDetails":
+		writeValue(w, "<struct><member><name>label</name><value><string>base</string></value></member></struct>")
+	default:
+		writeFault(w, -208, "No such channel: missing")
+	}
+}
+
+func writeValue(w http.ResponseWriter, value string) {
+	fmt.Fprintf(w, `<?xml version="1.0"?><methodResponse><params><param><value>%s</value></param></params></methodResponse>`, value)
+}
+
+func writeFault(w http.ResponseWriter, code int, message string) {
+	fmt.Fprintf(w, `<?xml version="1.0"?><methodResponse><fault><value><struct>`+
+		`<member><name>faultCode</name><value><int>%d</int></value></member>`+
+		`<member><name>faultString</name><value><string>%s</string></value></member>`+
+		`</struct></value></fault></methodResponse>`, code, message)
+}
+
+func TestClientFault(t *testing.T) {
+	server := httptest.NewServer(&fakeServer{logins: 1})
+	defer server.Close()
+
+	c := NewClient(server.URL).SetUser("admin", "secret")
+	_, err := c.GetRepoDetails(context.Background(), "missing")
+	fault := AsFault(err)
+	if fault == nil || fault.Code != -208 || fault.Method != "channel.software.getRepoDetails" {
+		t.Fatalf("expected fault -208 of the call, got %v", err)
+	}
+	if !IsNotFound(err) || IsSessionExpired(err) || IsAlreadyExists(err) {
+		t.Fatalf("fault %v is classified wrong", err)
+	}
+	if IsNotFound(fmt.Errorf("no such host")) {
+		t.Fatal("error, which is not a fault, is classified as not found")
+	}
+}
+
+func TestClientRelogin(t *testing.T) {
+	fake := new(fakeServer)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := NewClient(server.URL).SetUser("admin", "secret")
+	channel, err := c.GetChannelDetails(context.Background(), "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Label != "base" {
+		t.Fatalf("got channel '%s'", channel.Label)
+	}
+	if fake.logins != 2 {
+		t.Fatalf("logged in %d times, expected once again after the expired session", fake.logins)
+	}
+
+	// Renewed session is kept
+	if _, err := c.GetChannelDetails(context.Background(), "base"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.logins != 2 {
+		t.Fatalf("logged in %d times with a valid session", fake.logins)
+	}
+}
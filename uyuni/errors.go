@@ -0,0 +1,57 @@
+package uyuni
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Fault is the XML-RPC fault, returned by the server
+type Fault struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("%s: fault %d: %s", f.Method, f.Code, f.Message)
+}
+
+// AsFault returns the server fault of the error, or nil
+func AsFault(err error) *Fault {
+	var fault *Fault
+	if errors.As(err, &fault) {
+		return fault
+	}
+	return nil
+}
+
+// Server reports these with generic fault codes, so they are told by the message
+func faultContains(err error, texts ...string) bool {
+	fault := AsFault(err)
+	if fault == nil {
+		return false
+	}
+	message := strings.ToLower(fault.Message)
+	for _, text := range texts {
+		if strings.Contains(message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSessionExpired returns true, if the session key is no longer valid
+func IsSessionExpired(err error) bool {
+	return faultContains(err, "could not find session", "invalid session", "session expired", "session has expired")
+}
+
+// IsNotFound returns true, if the entity of the call does not exist
+func IsNotFound(err error) bool {
+	return faultContains(err, "no such", "not found", "does not exist")
+}
+
+// IsAlreadyExists returns true, if the entity to create is already there
+func IsAlreadyExists(err error) bool {
+	return faultContains(err, "already in use", "already exists")
+}
@@ -0,0 +1,37 @@
+package uyuni
+
+import (
+	"context"
+)
+
+// Org details, as in "org.getDetails"
+type Org struct {
+	Id     int    `xmlrpc:"id" json:"id"`
+	Name   string `xmlrpc:"name" json:"name"`
+	Active int    `xmlrpc:"active_users" json:"active_users"`
+}
+
+// CryptoKey is a GPG or SSL key, as in "kickstart.keys.getDetails"
+type CryptoKey struct {
+	Description string `xmlrpc:"description" json:"description"`
+	Type        string `xmlrpc:"type" json:"type"`
+	Content     string `xmlrpc:"content" json:"content"`
+}
+
+// GetOrgDetails returns the organization by its id
+func (c *Client) GetOrgDetails(ctx context.Context, id int) (*Org, error) {
+	org := new(Org)
+	if err := c.SessionCall(ctx, "org.getDetails", org, id); err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// GetCryptoKey returns the key by its description
+func (c *Client) GetCryptoKey(ctx context.Context, description string) (*CryptoKey, error) {
+	key := new(CryptoKey)
+	if err := c.SessionCall(ctx, "kickstart.keys.getDetails", key, description); err != nil {
+		return nil, err
+	}
+	return key, nil
+}